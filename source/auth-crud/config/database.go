@@ -37,11 +37,27 @@ func ConnectDB() error {
 
 	loggers.Info("Connected to database successfully")
 	loggers.Info("Running DB migrations...")
-	DB.AutoMigrate(&models.User{}, &models.Video{}, &models.Category{})
+	DB.AutoMigrate(&models.User{}, &models.Video{}, &models.Category{}, &models.RefreshToken{}, &models.RevokedToken{}, &models.OneTimeToken{}, &models.MFARecoveryCode{}, &models.Role{}, &models.Permission{}, &models.LoginThrottle{}, &models.APIKey{}, &models.ExternalIdentity{}, &models.OIDCLoginState{}, &models.Session{}, &models.AuditEvent{}, &models.SchemaMigration{})
+	if err := runMigrationOnce("backfill_email_verified_at", backfillEmailVerification); err != nil {
+		return fmt.Errorf("Failed to backfill email verification: %w", err)
+	}
+	if err := migrateRBAC(); err != nil {
+		return fmt.Errorf("Failed to migrate roles and permissions: %w", err)
+	}
+	if err := runMigrationOnce("legacy_admins_to_superadmin", migrateLegacyAdmins); err != nil {
+		return fmt.Errorf("Failed to migrate legacy admins: %w", err)
+	}
+	if err := migrateVideoDurations(); err != nil {
+		return fmt.Errorf("Failed to migrate video durations: %w", err)
+	}
 
 	if os.Getenv("SEED_DATA") == "true" {
 		seedDatabase()
 	}
+	// Index videos written before full-text search existed, or by the seeds
+	if err := DB.Exec("UPDATE videos SET search_vector = " + models.VideoSearchVectorSQL + " WHERE search_vector IS NULL").Error; err != nil {
+		return fmt.Errorf("Failed to index videos for search: %w", err)
+	}
 
 	return nil
 }
@@ -62,7 +78,14 @@ func seedDatabase() {
 		for i := 1; i <= 30; i++ {
 			email := fmt.Sprintf("user%02d@example.com", i)
 			pwd, _ := utils.HashPassword("Passw0rd!")
-			DB.Create(&models.User{Email: email, Password: pwd, IsAdmin: i == 1})
+			now := time.Now()
+			user := models.User{Email: email, Password: pwd, EmailVerifiedAt: &now}
+			if i == 1 {
+				var superadmin models.Role
+				DB.Where("name = ?", models.RoleSuperadmin).First(&superadmin)
+				user.Roles = []models.Role{superadmin}
+			}
+			DB.Create(&user)
 		}
 	}
 	// Videos
@@ -72,12 +95,13 @@ func seedDatabase() {
 		DB.Find(&cats)
 		for i := 1; i <= 30; i++ {
 			c := cats[rand.Intn(len(cats))]
+			duration := int64(5+(i%15)) * 60
 			DB.Create(&models.Video{
-				Title:         fmt.Sprintf("Video %02d", i),
-				Duration:      fmt.Sprintf("%dm", 5+(i%15)),
-				URL:           fmt.Sprintf("https://example.com/video%02d.mp4", i),
-				ThumbnailPath: "/uploads/sample.png",
-				CategoryID:    c.ID,
+				Title:           fmt.Sprintf("Video %02d", i),
+				DurationSeconds: &duration,
+				URL:             fmt.Sprintf("https://example.com/video%02d.mp4", i),
+				ThumbnailPath:   "/uploads/sample.png",
+				CategoryID:      c.ID,
 			})
 		}
 	}
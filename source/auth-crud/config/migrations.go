@@ -0,0 +1,44 @@
+package config
+
+import (
+	"auth-crud/loggers"
+	"auth-crud/models"
+	"errors"
+
+	"gorm.io/gorm"
+)
+
+// runMigrationOnce runs fn in a transaction, together with the record that
+// the migration called name was applied, unless it already was.
+func runMigrationOnce(name string, fn func(tx *gorm.DB) error) error {
+	return DB.Transaction(func(tx *gorm.DB) error {
+		var applied models.SchemaMigration
+		err := tx.Where("name = ?", name).First(&applied).Error
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		if err := fn(tx); err != nil {
+			return err
+		}
+		return tx.Create(&models.SchemaMigration{Name: name}).Error
+	})
+}
+
+// backfillEmailVerification marks accounts created before email verification
+// existed as verified, so that turning on REQUIRE_EMAIL_VERIFICATION doesn't
+// lock them out. Accounts that were ever sent a verification link signed up
+// afterwards and keep their state.
+func backfillEmailVerification(tx *gorm.DB) error {
+	res := tx.Exec(`UPDATE users SET email_verified_at = created_at
+		WHERE email_verified_at IS NULL AND NOT EXISTS (
+			SELECT 1 FROM one_time_tokens t WHERE t.user_id = users.id AND t.purpose = 'email_verification'
+		)`)
+	if res.Error != nil {
+		return res.Error
+	}
+	loggers.Info("Marked ", res.RowsAffected, " existing account(s) as email verified")
+	return nil
+}
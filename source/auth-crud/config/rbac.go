@@ -0,0 +1,60 @@
+package config
+
+import (
+	"auth-crud/loggers"
+	"auth-crud/models"
+
+	"gorm.io/gorm"
+)
+
+// migrateRBAC creates the known permissions and built-in roles.
+func migrateRBAC() error {
+	return DB.Transaction(func(tx *gorm.DB) error {
+		permissions := map[string]models.Permission{}
+		for _, name := range models.AllPermissions {
+			p := models.Permission{Name: name}
+			if err := tx.Where("name = ?", name).FirstOrCreate(&p).Error; err != nil {
+				return err
+			}
+			permissions[name] = p
+		}
+
+		for name, granted := range models.BuiltInRoles {
+			role := models.Role{Name: name, BuiltIn: true}
+			if err := tx.Where("name = ?", name).FirstOrCreate(&role).Error; err != nil {
+				return err
+			}
+			perms := make([]models.Permission, 0, len(granted))
+			for _, p := range granted {
+				perms = append(perms, permissions[p])
+			}
+			if err := tx.Model(&role).Association("Permissions").Replace(perms); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// migrateLegacyAdmins gives the superadmin role to accounts flagged with the
+// legacy users.is_admin column. It runs once, so that admins demoted later
+// aren't promoted again. The column is left in place (new accounts get its
+// default, false) so that an earlier release can still run against the
+// database; dropping it is left to a later migration.
+func migrateLegacyAdmins(tx *gorm.DB) error {
+	if !tx.Migrator().HasColumn(&models.User{}, "is_admin") {
+		return nil
+	}
+	var superadmin models.Role
+	if err := tx.Where("name = ?", models.RoleSuperadmin).First(&superadmin).Error; err != nil {
+		return err
+	}
+	res := tx.Exec(`INSERT INTO user_roles (user_id, role_id)
+		SELECT id, ? FROM users WHERE is_admin = true
+		ON CONFLICT DO NOTHING`, superadmin.ID)
+	if res.Error != nil {
+		return res.Error
+	}
+	loggers.Info("Migrated ", res.RowsAffected, " admin(s) to the superadmin role")
+	return nil
+}
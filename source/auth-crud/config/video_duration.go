@@ -0,0 +1,74 @@
+package config
+
+import (
+	"auth-crud/loggers"
+	"auth-crud/models"
+)
+
+// migrateVideoDurations converts the legacy free-form videos.duration column
+// into duration_seconds. The old column is kept as duration_legacy while some
+// of its values can't be parsed: those videos keep a NULL duration_seconds
+// (an unknown duration, not a zero one) and are logged at every start until
+// their duration is set through the API. The column is dropped once every row
+// has been converted or set.
+func migrateVideoDurations() error {
+	migrator := DB.Migrator()
+	// duration_seconds used to be NOT NULL DEFAULT 0, with 0 standing for
+	// unparsed legacy values
+	if err := DB.Exec("ALTER TABLE videos ALTER COLUMN duration_seconds DROP NOT NULL, ALTER COLUMN duration_seconds DROP DEFAULT").Error; err != nil {
+		return err
+	}
+	if migrator.HasColumn(&models.Video{}, "duration") {
+		if err := migrator.RenameColumn(&models.Video{}, "duration", "duration_legacy"); err != nil {
+			return err
+		}
+		if err := DB.Exec("ALTER TABLE videos ALTER COLUMN duration_legacy DROP NOT NULL").Error; err != nil {
+			return err
+		}
+	}
+	if !migrator.HasColumn(&models.Video{}, "duration_legacy") {
+		return nil
+	}
+
+	// a duration set through the API since the last start replaces the legacy value
+	if err := DB.Exec("UPDATE videos SET duration_legacy = NULL WHERE duration_legacy IS NOT NULL AND duration_seconds <> 0").Error; err != nil {
+		return err
+	}
+	var rows []struct {
+		ID             uint
+		DurationLegacy string
+	}
+	// trashed videos are converted too, so that they can be restored intact
+	if err := DB.Raw("SELECT id, duration_legacy FROM videos WHERE duration_legacy IS NOT NULL").Scan(&rows).Error; err != nil {
+		return err
+	}
+	converted, unparsed := 0, 0
+	for _, row := range rows {
+		seconds, err := models.ParseVideoDuration(row.DurationLegacy)
+		if err != nil {
+			unparsed++
+			loggers.Log(map[string]interface{}{
+				"level":    "warn",
+				"msg":      "video duration can't be converted",
+				"video_id": row.ID,
+				"duration": row.DurationLegacy,
+			})
+			if err := DB.Exec("UPDATE videos SET duration_seconds = NULL WHERE id = ?", row.ID).Error; err != nil {
+				return err
+			}
+			continue
+		}
+		if err := DB.Exec("UPDATE videos SET duration_seconds = ?, duration_legacy = NULL WHERE id = ?", seconds, row.ID).Error; err != nil {
+			return err
+		}
+		converted++
+	}
+	if converted > 0 {
+		loggers.Info("Converted the duration of ", converted, " video(s) to seconds")
+	}
+	if unparsed > 0 {
+		loggers.Error(unparsed, " video duration(s) couldn't be converted and are null; set them with PUT /api/admin/v1/videos/{id}")
+		return nil
+	}
+	return migrator.DropColumn(&models.Video{}, "duration_legacy")
+}
@@ -0,0 +1,188 @@
+package handlers
+
+import (
+	"auth-crud/config"
+	"auth-crud/middlewares"
+	"auth-crud/models"
+	"auth-crud/utils"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// apiKeyPrefix marks API keys so they are recognizable, e.g. by secret scanners.
+const apiKeyPrefix = "ak_"
+
+// APIKeyResponse describes an API key. Key is only set in the creation response.
+type APIKeyResponse struct {
+	ID         uint       `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Key        string     `json:"key,omitempty"`
+	Scopes     []string   `json:"scopes"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// CreateAPIKeyInput creates a key. Scopes are permission names; none means the
+// key can do whatever the owner's roles allow. ExpiresAt is optional.
+type CreateAPIKeyInput struct {
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+// apiKeyAuditFields is the snapshot of an API key recorded in audit events.
+func apiKeyAuditFields(key *models.APIKey) map[string]interface{} {
+	return map[string]interface{}{
+		"name":       key.Name,
+		"prefix":     key.Prefix,
+		"scopes":     key.ScopeList(),
+		"expires_at": key.ExpiresAt,
+		"revoked_at": key.RevokedAt,
+	}
+}
+
+func newAPIKeyResponse(key *models.APIKey) APIKeyResponse {
+	return APIKeyResponse{
+		ID:         key.ID,
+		Name:       key.Name,
+		Prefix:     key.Prefix,
+		Scopes:     key.ScopeList(),
+		ExpiresAt:  key.ExpiresAt,
+		LastUsedAt: key.LastUsedAt,
+		RevokedAt:  key.RevokedAt,
+		CreatedAt:  key.CreatedAt,
+	}
+}
+
+// ListAPIKeys lists the authenticated user's API keys, newest first. Secrets are never returned.
+func ListAPIKeys(w http.ResponseWriter, r *http.Request) {
+	user, ok := middlewares.GetAuthenticatedUser(r)
+	if !ok {
+		utils.JSONError(w, r, http.StatusUnauthorized, "Unauthorized", "unauthorized", "")
+		return
+	}
+	var keys []models.APIKey
+	if err := config.DB.Where("user_id = ?", user.ID).Order("id desc").Find(&keys).Error; err != nil {
+		utils.JSONError(w, r, http.StatusInternalServerError, "Failed to get API keys", "db_query_failed", err.Error())
+		return
+	}
+	items := make([]APIKeyResponse, len(keys))
+	for i := range keys {
+		items[i] = newAPIKeyResponse(&keys[i])
+	}
+	utils.JSONSuccess(w, r, "Successfully retrieved the API keys", map[string]interface{}{
+		"items": items,
+	})
+}
+
+// CreateAPIKey creates an API key for the authenticated user. The key is only
+// shown in this response; just its hash is stored.
+func CreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	user, ok := middlewares.GetAuthenticatedUser(r)
+	if !ok {
+		utils.JSONError(w, r, http.StatusUnauthorized, "Unauthorized", "unauthorized", "")
+		return
+	}
+	var input CreateAPIKeyInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		utils.JSONError(w, r, http.StatusBadRequest, "Invalid request body", "invalid_request", err.Error())
+		return
+	}
+	input.Name = strings.TrimSpace(input.Name)
+	if input.Name == "" {
+		utils.JSONError(w, r, http.StatusBadRequest, "Name is required", "validation_error", "missing name")
+		return
+	}
+	if input.ExpiresAt != nil && !input.ExpiresAt.After(time.Now()) {
+		utils.JSONError(w, r, http.StatusBadRequest, "Expiry must be in the future", "validation_error", "expires_at is in the past")
+		return
+	}
+	known := map[string]bool{}
+	for _, permission := range models.AllPermissions {
+		known[permission] = true
+	}
+	seen := map[string]bool{}
+	scopes := make([]string, 0, len(input.Scopes))
+	for _, scope := range input.Scopes {
+		if !known[scope] {
+			utils.JSONError(w, r, http.StatusBadRequest, "Unknown scope", "validation_error", "scopes must be permission names, got "+strconv.Quote(scope))
+			return
+		}
+		if !seen[scope] {
+			seen[scope] = true
+			scopes = append(scopes, scope)
+		}
+	}
+
+	secret, err := utils.GenerateOpaqueToken()
+	if err != nil {
+		utils.JSONError(w, r, http.StatusInternalServerError, "Failed to create API key", "token_failed", err.Error())
+		return
+	}
+	raw := apiKeyPrefix + secret
+	key := models.APIKey{
+		UserID:    user.ID,
+		Name:      input.Name,
+		Prefix:    raw[:len(apiKeyPrefix)+8],
+		KeyHash:   utils.HashToken(raw),
+		Scopes:    strings.Join(scopes, " "),
+		ExpiresAt: input.ExpiresAt,
+	}
+	if err := config.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&key).Error; err != nil {
+			return err
+		}
+		return recordAudit(tx, w, r, auditRecord{Action: "api_key.create", ResourceType: "api_key", ResourceID: key.ID, After: apiKeyAuditFields(&key)})
+	}); err != nil {
+		utils.JSONError(w, r, http.StatusInternalServerError, "Failed to create API key", "db_create_failed", err.Error())
+		return
+	}
+
+	resp := newAPIKeyResponse(&key)
+	resp.Key = raw
+	utils.JSONCreated(w, r, "API key created; store it now, it won't be shown again", resp)
+}
+
+// RevokeAPIKey revokes one of the authenticated user's API keys.
+func RevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	user, ok := middlewares.GetAuthenticatedUser(r)
+	if !ok {
+		utils.JSONError(w, r, http.StatusUnauthorized, "Unauthorized", "unauthorized", "")
+		return
+	}
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil || id <= 0 {
+		utils.JSONError(w, r, http.StatusBadRequest, "Invalid API key id", "validation_error", "")
+		return
+	}
+
+	var key models.APIKey
+	if err := config.DB.Where("id = ? AND user_id = ?", id, user.ID).First(&key).Error; err != nil {
+		utils.JSONError(w, r, http.StatusNotFound, "API key not found", "not_found", "")
+		return
+	}
+	if key.RevokedAt == nil {
+		before := apiKeyAuditFields(&key)
+		now := time.Now()
+		if err := config.DB.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Model(&models.APIKey{}).Where("id = ?", key.ID).Update("revoked_at", now).Error; err != nil {
+				return err
+			}
+			key.RevokedAt = &now
+			return recordAudit(tx, w, r, auditRecord{Action: "api_key.revoke", ResourceType: "api_key", ResourceID: key.ID, Before: before, After: apiKeyAuditFields(&key)})
+		}); err != nil {
+			utils.JSONError(w, r, http.StatusInternalServerError, "Failed to revoke API key", "db_update_failed", err.Error())
+			return
+		}
+	}
+
+	utils.JSONSuccess(w, r, "API key revoked successfully", newAPIKeyResponse(&key))
+}
@@ -0,0 +1,203 @@
+package handlers
+
+import (
+	"auth-crud/config"
+	"auth-crud/middlewares"
+	"auth-crud/models"
+	"auth-crud/utils"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// auditRecord describes one audited change. Before and After are snapshots of
+// the audited fields; nil means the resource didn't exist before / doesn't after.
+// ActorID defaults to the authenticated user and is needed for token-based
+// actions such as password resets, where nobody is logged in.
+type auditRecord struct {
+	Action       string
+	ResourceType string
+	ResourceID   interface{}
+	ActorID      uint
+	Before       map[string]interface{}
+	After        map[string]interface{}
+}
+
+type auditChange struct {
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+// AuditEventResponse is the admin view of an audit event.
+type AuditEventResponse struct {
+	ID             uint            `json:"id"`
+	ActorID        *uint           `json:"actor_id"`
+	ImpersonatorID *uint           `json:"impersonator_id,omitempty"`
+	Action         string          `json:"action"`
+	ResourceType   string          `json:"resource_type"`
+	ResourceID     string          `json:"resource_id"`
+	Changes        json.RawMessage `json:"changes"`
+	RequestID      string          `json:"request_id"`
+	IP             string          `json:"ip"`
+	CreatedAt      time.Time       `json:"created_at"`
+}
+
+// auditDiff keeps the fields whose JSON encoding differs between before and after.
+func auditDiff(before, after map[string]interface{}) (map[string]auditChange, error) {
+	changes := map[string]auditChange{}
+	for _, fields := range []map[string]interface{}{before, after} {
+		for name := range fields {
+			if _, done := changes[name]; done {
+				continue
+			}
+			b, err := json.Marshal(before[name])
+			if err != nil {
+				return nil, err
+			}
+			a, err := json.Marshal(after[name])
+			if err != nil {
+				return nil, err
+			}
+			if before == nil || after == nil || !bytes.Equal(a, b) {
+				changes[name] = auditChange{Before: before[name], After: after[name]}
+			}
+		}
+	}
+	return changes, nil
+}
+
+// recordAudit stores an audit event for a change made by the request. Call it
+// inside the transaction making the change so that both commit together.
+func recordAudit(tx *gorm.DB, w http.ResponseWriter, r *http.Request, rec auditRecord) error {
+	changes, err := auditDiff(rec.Before, rec.After)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(changes)
+	if err != nil {
+		return err
+	}
+
+	event := models.AuditEvent{
+		Action:       rec.Action,
+		ResourceType: rec.ResourceType,
+		ResourceID:   fmt.Sprint(rec.ResourceID),
+		Changes:      string(data),
+		RequestID:    utils.GetOrSetRequestID(w, r),
+		IP:           utils.ClientIP(r),
+	}
+	if rec.ActorID != 0 {
+		event.ActorID = &rec.ActorID
+	} else if user, ok := middlewares.GetAuthenticatedUser(r); ok {
+		event.ActorID = &user.ID
+	}
+	if actor, ok := middlewares.GetImpersonator(r); ok {
+		event.ImpersonatorID = &actor.ID
+	}
+	return tx.Create(&event).Error
+}
+
+// parseAuditTime reads an RFC 3339 query parameter, writing a 400 response when it is invalid.
+func parseAuditTime(w http.ResponseWriter, r *http.Request, name string) (*time.Time, bool) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return nil, true
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		utils.JSONError(w, r, http.StatusBadRequest, "Invalid "+name, "validation_error", name+" must be an RFC 3339 time")
+		return nil, false
+	}
+	return &t, true
+}
+
+// ListAuditEvents lists audit events, newest first by default, with cursor
+// pagination. Filters: actor_id, action, resource_type, resource_id, request_id,
+// since and until (RFC 3339).
+func ListAuditEvents(w http.ResponseWriter, r *http.Request) {
+	page, ok := parseKeysetPage(w, r)
+	if !ok {
+		return
+	}
+	// ids follow creation, so events are only listed by id
+	page.SortBy = "id"
+	query := r.URL.Query()
+	if page.Cursor == nil && query.Get("order") == "" {
+		page.Order = "desc"
+	}
+
+	q := config.DB.Model(&models.AuditEvent{})
+	if v := query.Get("actor_id"); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil || id <= 0 {
+			utils.JSONError(w, r, http.StatusBadRequest, "Invalid actor_id", "validation_error", "")
+			return
+		}
+		q = q.Where("actor_id = ?", id)
+	}
+	if v := strings.TrimSpace(query.Get("action")); v != "" {
+		// "video" matches every video.* action
+		if strings.Contains(v, ".") {
+			q = q.Where("action = ?", v)
+		} else {
+			escaped := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(v)
+			q = q.Where("action LIKE ?", escaped+".%")
+		}
+	}
+	for _, column := range []string{"resource_type", "resource_id", "request_id"} {
+		if v := strings.TrimSpace(query.Get(column)); v != "" {
+			q = q.Where(column+" = ?", v)
+		}
+	}
+	since, ok := parseAuditTime(w, r, "since")
+	if !ok {
+		return
+	}
+	if since != nil {
+		q = q.Where("created_at >= ?", *since)
+	}
+	until, ok := parseAuditTime(w, r, "until")
+	if !ok {
+		return
+	}
+	if until != nil {
+		q = q.Where("created_at < ?", *until)
+	}
+
+	var events []models.AuditEvent
+	if err := page.apply(q, "audit_events").Find(&events).Error; err != nil {
+		utils.JSONError(w, r, http.StatusInternalServerError, "Failed to get audit events", "db_query_failed", err.Error())
+		return
+	}
+	events, nextCursor, prevCursor := pageCursors(page, events, func(e *models.AuditEvent) (time.Time, uint) {
+		return e.CreatedAt, e.ID
+	})
+
+	items := make([]AuditEventResponse, len(events))
+	for i, e := range events {
+		items[i] = AuditEventResponse{
+			ID:             e.ID,
+			ActorID:        e.ActorID,
+			ImpersonatorID: e.ImpersonatorID,
+			Action:         e.Action,
+			ResourceType:   e.ResourceType,
+			ResourceID:     e.ResourceID,
+			Changes:        json.RawMessage(e.Changes),
+			RequestID:      e.RequestID,
+			IP:             e.IP,
+			CreatedAt:      e.CreatedAt,
+		}
+	}
+
+	utils.JSONSuccess(w, r, "Successfully retrieved the audit events", map[string]interface{}{
+		"items":       items,
+		"next_cursor": nextCursor,
+		"prev_cursor": prevCursor,
+	})
+}
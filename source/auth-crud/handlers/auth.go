@@ -2,11 +2,20 @@ package handlers
 
 import (
 	"auth-crud/config"
+	"auth-crud/loggers"
+	"auth-crud/middlewares"
 	"auth-crud/models"
 	"auth-crud/utils"
 	"encoding/json"
+	"errors"
+	"io"
 	"net/http"
+	"net/mail"
+	"strconv"
 	"strings"
+	"time"
+
+	"gorm.io/gorm"
 )
 
 type RegisterInput struct {
@@ -19,6 +28,58 @@ type LoginInput struct {
 	Password string `json:"password"`
 }
 
+type RefreshInput struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+type LogoutInput struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// validEmail reports whether email is a bare address such as "user@example.com".
+func validEmail(email string) bool {
+	addr, err := mail.ParseAddress(email)
+	return err == nil && addr.Address == email
+}
+
+// weakPasswordError carries the password policy rules a new password breaks.
+type weakPasswordError struct {
+	reasons []string
+}
+
+func (e *weakPasswordError) Error() string {
+	return "password rejected: " + strings.Join(e.reasons, "; ")
+}
+
+// writeWeakPassword responds with a 400 listing every rule the password breaks.
+func writeWeakPassword(w http.ResponseWriter, r *http.Request, err *weakPasswordError) {
+	utils.JSONError(w, r, http.StatusBadRequest, "Password does not meet the password policy", "weak_password", strings.Join(err.reasons, "; "))
+}
+
+// passwordAcceptable checks a new password against the policy, writing a 400
+// response when it is rejected.
+func passwordAcceptable(w http.ResponseWriter, r *http.Request, password, email string) bool {
+	if reasons := utils.ValidatePassword(password, email); len(reasons) > 0 {
+		writeWeakPassword(w, r, &weakPasswordError{reasons: reasons})
+		return false
+	}
+	return true
+}
+
+// accountUsable rejects accounts that may not obtain tokens: disabled ones, and
+// unverified ones when REQUIRE_EMAIL_VERIFICATION is on.
+func accountUsable(w http.ResponseWriter, r *http.Request, user *models.User) bool {
+	if user.DisabledAt != nil {
+		utils.JSONError(w, r, http.StatusForbidden, "Account disabled", "account_disabled", "")
+		return false
+	}
+	if utils.EmailVerificationRequired() && user.EmailVerifiedAt == nil {
+		utils.JSONError(w, r, http.StatusForbidden, "Email address not verified", "email_not_verified", "verify your email before logging in")
+		return false
+	}
+	return true
+}
+
 func Register(w http.ResponseWriter, r *http.Request) {
 	var input RegisterInput
 	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
@@ -32,6 +93,15 @@ func Register(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !validEmail(input.Email) {
+		utils.JSONError(w, r, http.StatusBadRequest, "Invalid email address", "validation_error", "malformed email")
+		return
+	}
+
+	if !passwordAcceptable(w, r, input.Password, input.Email) {
+		return
+	}
+
 	// check uniqueness
 	var existing models.User
 	if err := config.DB.Where("email = ?", input.Email).First(&existing).Error; err == nil {
@@ -55,12 +125,45 @@ func Register(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := sendVerificationEmail(&user); err != nil {
+		loggers.Error("Failed to send verification email: ", err)
+	}
+
 	utils.JSONCreated(w, r, "User created successfully", map[string]interface{}{
-		"id":    user.ID,
-		"email": user.Email,
+		"id":             user.ID,
+		"email":          user.Email,
+		"email_verified": false,
 	})
 }
 
+// createPasswordlessUser creates an account for someone signing in without a
+// password (magic link, external identity). It gets an unguessable password;
+// the user can set one through password reset.
+func createPasswordlessUser(tx *gorm.DB, user *models.User, email string, emailVerified bool) error {
+	random, err := utils.GenerateOpaqueToken()
+	if err != nil {
+		return err
+	}
+	hashed, err := utils.HashPassword(random)
+	if err != nil {
+		return err
+	}
+	*user = models.User{Email: email, Password: hashed}
+	if emailVerified {
+		now := time.Now()
+		user.EmailVerifiedAt = &now
+	}
+	if err := tx.Create(user).Error; err != nil {
+		return err
+	}
+	loggers.Log(map[string]interface{}{
+		"level":   "info",
+		"msg":     "created passwordless account",
+		"user_id": user.ID,
+	})
+	return nil
+}
+
 func Login(w http.ResponseWriter, r *http.Request) {
 	var input LoginInput
 	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
@@ -74,22 +177,171 @@ func Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	keys := loginThrottleKeys(email, utils.ClientIP(r))
+	if until, locked := loginLockedUntil(keys); locked {
+		w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(until).Seconds())+1))
+		utils.JSONError(w, r, http.StatusTooManyRequests, "Too many failed login attempts, try again later", "too_many_attempts", "")
+		return
+	}
+
+	// unknown emails and wrong passwords get the same response after the same
+	// amount of work, so the endpoint can't be used to enumerate accounts
 	var user models.User
-	if err := config.DB.Where("email = ?", email).First(&user).Error; err != nil {
-		utils.JSONError(w, r, http.StatusNotFound, "User not found", "user_not_found", "no user for email")
+	found := config.DB.Where("email = ?", email).First(&user).Error == nil
+	hash := user.Password
+	if !found {
+		hash = dummyPasswordHash()
+	}
+	if err := utils.VerifyPassword(input.Password, hash); err != nil || !found {
+		recordLoginFailure(keys)
+		utils.JSONError(w, r, http.StatusUnauthorized, "Invalid credentials", "invalid_credentials", "")
 		return
 	}
+	clearLoginFailures(email)
+	upgradePasswordHash(&user, input.Password)
 
-	if err := utils.VerifyPassword(input.Password, user.Password); err != nil {
-		utils.JSONError(w, r, http.StatusUnauthorized, "Invalid credentials", "invalid_credentials", "password mismatch")
+	if !accountUsable(w, r, &user) {
 		return
 	}
 
-	token, err := utils.GenerateToken(user.ID)
+	completeLogin(w, r, &user, "User logged in successfully")
+}
+
+// upgradePasswordHash rehashes a just-verified password when its stored hash
+// uses an outdated algorithm or cost. Failures are logged; the login proceeds.
+func upgradePasswordHash(user *models.User, password string) {
+	if !utils.PasswordNeedsRehash(user.Password) {
+		return
+	}
+	hashed, err := utils.HashPassword(password)
 	if err != nil {
-		utils.JSONError(w, r, http.StatusInternalServerError, "Failed to generate token", "token_failed", err.Error())
+		loggers.Error("Failed to rehash password: ", err)
+		return
+	}
+	if err := config.DB.Model(&models.User{}).Where("id = ? AND password = ?", user.ID, user.Password).Update("password", hashed).Error; err != nil {
+		loggers.Error("Failed to store rehashed password: ", err)
+		return
+	}
+	user.Password = hashed
+}
+
+// Refresh exchanges a refresh token for a new access/refresh token pair.
+// Each refresh token is single-use; presenting a consumed one revokes its whole family.
+func Refresh(w http.ResponseWriter, r *http.Request) {
+	var input RefreshInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		utils.JSONError(w, r, http.StatusBadRequest, "Invalid request body", "invalid_request", err.Error())
+		return
+	}
+	if input.RefreshToken == "" {
+		utils.JSONError(w, r, http.StatusBadRequest, "Refresh token is required", "validation_error", "missing refresh_token")
+		return
+	}
+
+	var current models.RefreshToken
+	if err := config.DB.Where("token_hash = ?", utils.HashToken(input.RefreshToken)).First(&current).Error; err != nil {
+		utils.JSONError(w, r, http.StatusUnauthorized, "Invalid refresh token", "invalid_refresh_token", "")
+		return
+	}
+	if current.RevokedAt != nil && current.ReplacedByID == nil {
+		utils.JSONError(w, r, http.StatusUnauthorized, "Invalid refresh token", "refresh_token_revoked", "")
+		return
+	}
+	if current.RevokedAt != nil {
+		revokeRefreshFamily(current.FamilyID, current.UserID)
+		utils.JSONError(w, r, http.StatusUnauthorized, "Invalid refresh token", "refresh_token_reused", "token already used, session revoked")
+		return
+	}
+	if time.Now().After(current.ExpiresAt) {
+		utils.JSONError(w, r, http.StatusUnauthorized, "Refresh token expired", "refresh_token_expired", "")
+		return
+	}
+
+	var user models.User
+	if err := config.DB.First(&user, current.UserID).Error; err != nil {
+		utils.JSONError(w, r, http.StatusUnauthorized, "Invalid refresh token", "invalid_refresh_token", "user no longer exists")
+		return
+	}
+	if !accountUsable(w, r, &user) {
+		return
+	}
+
+	tokens, err := rotateRefreshToken(r, &user, &current)
+	if errors.Is(err, errRefreshTokenReused) {
+		revokeRefreshFamily(current.FamilyID, current.UserID)
+		utils.JSONError(w, r, http.StatusUnauthorized, "Invalid refresh token", "refresh_token_reused", "token already used, session revoked")
+		return
+	}
+	if err != nil {
+		utils.JSONError(w, r, http.StatusInternalServerError, "Failed to refresh token", "token_failed", err.Error())
+		return
+	}
+
+	utils.JSONSuccess(w, r, "Token refreshed successfully", tokens)
+}
+
+// Logout revokes the access token used for the request and ends its session,
+// which revokes the session's refresh tokens. Tokens from before sessions existed
+// carry none; for them the refresh token (and its family) can be given in the body.
+func Logout(w http.ResponseWriter, r *http.Request) {
+	claims, ok := middlewares.GetTokenClaims(r)
+	if !ok {
+		utils.JSONError(w, r, http.StatusUnauthorized, "Unauthorized", "unauthorized", "")
+		return
+	}
+
+	// the body is optional for logout
+	var input LogoutInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil && !errors.Is(err, io.EOF) {
+		utils.JSONError(w, r, http.StatusBadRequest, "Invalid request body", "invalid_request", err.Error())
+		return
+	}
+
+	if err := revokeAccessToken(claims); err != nil {
+		utils.JSONError(w, r, http.StatusInternalServerError, "Failed to revoke token", "db_update_failed", err.Error())
+		return
+	}
+	if claims.SessionID != "" {
+		if err := revokeSession(config.DB, claims.UserID, claims.SessionID); err != nil {
+			utils.JSONError(w, r, http.StatusInternalServerError, "Failed to revoke session", "db_update_failed", err.Error())
+			return
+		}
+	}
+
+	if input.RefreshToken != "" {
+		var refresh models.RefreshToken
+		err := config.DB.Where("token_hash = ? AND user_id = ?", utils.HashToken(input.RefreshToken), claims.UserID).First(&refresh).Error
+		if err == nil {
+			err = config.DB.Model(&models.RefreshToken{}).
+				Where("family_id = ? AND revoked_at IS NULL", refresh.FamilyID).
+				Update("revoked_at", time.Now()).Error
+			if err != nil {
+				utils.JSONError(w, r, http.StatusInternalServerError, "Failed to revoke token", "db_update_failed", err.Error())
+				return
+			}
+		}
+	}
+
+	utils.JSONSuccess(w, r, "User logged out successfully", nil)
+}
+
+// LogoutAll revokes every access and refresh token issued to the user.
+func LogoutAll(w http.ResponseWriter, r *http.Request) {
+	user, ok := middlewares.GetAuthenticatedUser(r)
+	if !ok {
+		utils.JSONError(w, r, http.StatusUnauthorized, "Unauthorized", "unauthorized", "")
+		return
+	}
+
+	if err := config.DB.Transaction(func(tx *gorm.DB) error {
+		if err := revokeUserSessions(tx, user.ID); err != nil {
+			return err
+		}
+		return recordAudit(tx, w, r, auditRecord{Action: "session.revoke_all", ResourceType: "user", ResourceID: user.ID})
+	}); err != nil {
+		utils.JSONError(w, r, http.StatusInternalServerError, "Failed to revoke sessions", "db_update_failed", err.Error())
 		return
 	}
 
-	utils.JSONSuccess(w, r, "User logged in successfully", map[string]string{"token": token})
+	utils.JSONSuccess(w, r, "User logged out of all sessions successfully", nil)
 }
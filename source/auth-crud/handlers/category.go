@@ -5,43 +5,43 @@ import (
 	"auth-crud/models"
 	"auth-crud/utils"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var (
+	errCategoryInUse     = errors.New("category has videos")
+	errCategoryNameClash = errors.New("subcategories would clash with their new siblings")
 )
 
 func GetCategories(w http.ResponseWriter, r *http.Request) {
-	limit, cursor, sortBy, order := utils.ParsePagination(r)
+	page, ok := parseKeysetPage(w, r)
+	if !ok {
+		return
+	}
 	var categories []models.Category
 
-	q := config.DB.Model(&models.Category{})
-	if cursor != "" {
-		if id, err := strconv.Atoi(cursor); err == nil {
-			if order == "asc" {
-				q = q.Where("id > ?", id)
-			} else {
-				q = q.Where("id < ?", id)
-			}
-		}
-	}
-	if sortBy == "created_at" {
-		q = q.Order("created_at " + order)
-	} else {
-		q = q.Order("id " + order)
-	}
-	if err := q.Limit(limit).Find(&categories).Error; err != nil {
+	if err := page.apply(config.DB.Model(&models.Category{}), "categories").Find(&categories).Error; err != nil {
 		utils.JSONError(w, r, http.StatusInternalServerError, "Failed to get categories", "db_query_failed", err.Error())
 		return
 	}
-
-	nextCursor := ""
-	if len(categories) > 0 {
-		last := categories[len(categories)-1]
-		nextCursor = utils.BuildNextCursor(len(categories), limit, last.ID)
+	categories, nextCursor, prevCursor := pageCursors(page, categories, func(c *models.Category) (time.Time, uint) {
+		return c.CreatedAt, c.ID
+	})
+	if err := attachBreadcrumbs(config.DB, categories); err != nil {
+		utils.JSONError(w, r, http.StatusInternalServerError, "Failed to get categories", "db_query_failed", err.Error())
+		return
 	}
 
 	utils.JSONSuccess(w, r, "Successfully retrieved the categories", map[string]interface{}{
 		"items":       categories,
 		"next_cursor": nextCursor,
+		"prev_cursor": prevCursor,
 	})
 }
 
@@ -52,31 +52,242 @@ func GetCategory(w http.ResponseWriter, r *http.Request) {
 		utils.JSONError(w, r, http.StatusNotFound, "Category not found", "not_found", "")
 		return
 	}
-	utils.JSONSuccess(w, r, "Successfully retrieved the category", category)
+	categories := []models.Category{category}
+	if err := attachBreadcrumbs(config.DB, categories); err != nil {
+		utils.JSONError(w, r, http.StatusInternalServerError, "Failed to get category", "db_query_failed", err.Error())
+		return
+	}
+	utils.JSONSuccess(w, r, "Successfully retrieved the category", categories[0])
 }
 
+// CreateCategory creates a category, below parent_id when given.
 func CreateCategory(w http.ResponseWriter, r *http.Request) {
-	var input models.Category
+	var input CategoryInput
 	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
 		utils.JSONError(w, r, http.StatusBadRequest, "Invalid request body", "invalid_request", err.Error())
 		return
 	}
+	input.Name = strings.TrimSpace(input.Name)
 	if input.Name == "" {
 		utils.JSONError(w, r, http.StatusBadRequest, "Name is required", "validation_error", "")
 		return
 	}
 
-	// ensure unique name
-	var exists models.Category
-	if err := config.DB.Where("name = ?", input.Name).First(&exists).Error; err == nil {
-		utils.JSONError(w, r, http.StatusBadRequest, "Category already exists", "duplicate_name", "")
+	category := models.Category{Name: input.Name, ParentID: input.ParentID.ID}
+	err := config.DB.Transaction(func(tx *gorm.DB) error {
+		if category.ParentID != nil {
+			if err := checkCategoryParent(tx, 0, *category.ParentID); err != nil {
+				return err
+			}
+		}
+		if err := checkCategoryName(tx, category.Name, category.ParentID, 0); err != nil {
+			return err
+		}
+		if err := tx.Create(&category).Error; err != nil {
+			return err
+		}
+		return recordAudit(tx, w, r, auditRecord{Action: "category.create", ResourceType: "category", ResourceID: category.ID, After: categoryAuditFields(&category)})
+	})
+	if writeCategoryTreeError(w, r, err) {
 		return
 	}
-
-	category := models.Category{Name: input.Name}
-	if err := config.DB.Create(&category).Error; err != nil {
+	if err != nil {
 		utils.JSONError(w, r, http.StatusInternalServerError, "Failed to create category", "db_create_failed", err.Error())
 		return
 	}
-	utils.JSONCreated(w, r, "Category created successfully", category)
+	categories := []models.Category{category}
+	if err := attachBreadcrumbs(config.DB, categories); err != nil {
+		utils.JSONError(w, r, http.StatusInternalServerError, "Failed to get category", "db_query_failed", err.Error())
+		return
+	}
+	utils.JSONCreated(w, r, "Category created successfully", categories[0])
+}
+
+// CategoryInput is the payload for creating and updating a category. On update
+// both fields are optional; "parent_id": null moves the category to the top level.
+type CategoryInput struct {
+	Name     string     `json:"name"`
+	ParentID nullableID `json:"parent_id"`
+}
+
+// categoryAuditFields is the snapshot of a category recorded in audit events.
+func categoryAuditFields(c *models.Category) map[string]interface{} {
+	return map[string]interface{}{
+		"name":      c.Name,
+		"parent_id": c.ParentID,
+	}
+}
+
+// parseCategoryID reads the {id} path value, writing a 400 response when it is invalid.
+func parseCategoryID(w http.ResponseWriter, r *http.Request) (uint, bool) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil || id <= 0 {
+		utils.JSONError(w, r, http.StatusBadRequest, "Invalid category id", "validation_error", "")
+		return 0, false
+	}
+	return uint(id), true
+}
+
+// UpdateCategory renames a category or moves it in the tree. Its name must not
+// belong to another category under the same parent, and a category can't be
+// moved below itself.
+func UpdateCategory(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseCategoryID(w, r)
+	if !ok {
+		return
+	}
+	var input CategoryInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		utils.JSONError(w, r, http.StatusBadRequest, "Invalid request body", "invalid_request", err.Error())
+		return
+	}
+	input.Name = strings.TrimSpace(input.Name)
+	if input.Name == "" && !input.ParentID.Set {
+		utils.JSONError(w, r, http.StatusBadRequest, "Nothing to update", "validation_error", "give name and/or parent_id")
+		return
+	}
+
+	var category models.Category
+	if err := config.DB.First(&category, id).Error; err != nil {
+		utils.JSONError(w, r, http.StatusNotFound, "Category not found", "not_found", "")
+		return
+	}
+	before := categoryAuditFields(&category)
+	if input.Name != "" {
+		category.Name = input.Name
+	}
+	if input.ParentID.Set {
+		category.ParentID = input.ParentID.ID
+	}
+	err := config.DB.Transaction(func(tx *gorm.DB) error {
+		if input.ParentID.Set && category.ParentID != nil {
+			if err := checkCategoryParent(tx, category.ID, *category.ParentID); err != nil {
+				return err
+			}
+		}
+		if err := checkCategoryName(tx, category.Name, category.ParentID, category.ID); err != nil {
+			return err
+		}
+		if err := tx.Model(&models.Category{}).Where("id = ?", category.ID).Updates(map[string]interface{}{
+			"name":      category.Name,
+			"parent_id": category.ParentID,
+		}).Error; err != nil {
+			return err
+		}
+		return recordAudit(tx, w, r, auditRecord{Action: "category.update", ResourceType: "category", ResourceID: category.ID, Before: before, After: categoryAuditFields(&category)})
+	})
+	if writeCategoryTreeError(w, r, err) {
+		return
+	}
+	if err != nil {
+		utils.JSONError(w, r, http.StatusInternalServerError, "Failed to update category", "db_update_failed", err.Error())
+		return
+	}
+	categories := []models.Category{category}
+	if err := attachBreadcrumbs(config.DB, categories); err != nil {
+		utils.JSONError(w, r, http.StatusInternalServerError, "Failed to get category", "db_query_failed", err.Error())
+		return
+	}
+	utils.JSONSuccess(w, r, "Category updated successfully", categories[0])
+}
+
+// DeleteCategory deletes a category; its subcategories move up to its parent,
+// which is refused while one of them has the name of a category already there.
+// While videos (including trashed ones) still reference it, ?reassign_to=<category id>
+// is required and those videos are moved to that category in the same transaction.
+func DeleteCategory(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseCategoryID(w, r)
+	if !ok {
+		return
+	}
+	var category models.Category
+	if err := config.DB.First(&category, id).Error; err != nil {
+		utils.JSONError(w, r, http.StatusNotFound, "Category not found", "not_found", "")
+		return
+	}
+
+	var target *models.Category
+	if v := r.URL.Query().Get("reassign_to"); v != "" {
+		targetID, err := strconv.Atoi(v)
+		if err != nil || targetID <= 0 || uint(targetID) == category.ID {
+			utils.JSONError(w, r, http.StatusBadRequest, "Invalid reassign_to", "validation_error", "reassign_to must be the id of another category")
+			return
+		}
+		target = &models.Category{}
+		if err := config.DB.First(target, targetID).Error; err != nil {
+			utils.JSONError(w, r, http.StatusBadRequest, "Invalid reassign_to", "validation_error", "category to reassign to not found")
+			return
+		}
+	}
+
+	var videos int64
+	var clashes []string
+	err := config.DB.Transaction(func(tx *gorm.DB) error {
+		if err := lockCategoryTree(tx); err != nil {
+			return err
+		}
+		// the category may have moved or gone since it was read
+		if err := tx.First(&category, category.ID).Error; err != nil {
+			return err
+		}
+		// subcategories move up to the parent, where their names must stay unique
+		if err := tx.Model(&models.Category{}).Where("parent_id = ?", category.ID).
+			Where("name IN (?)", categorySiblings(tx, category.ParentID).Select("name").Where("id <> ?", category.ID)).
+			Order("name").Pluck("name", &clashes).Error; err != nil {
+			return err
+		}
+		if len(clashes) > 0 {
+			return errCategoryNameClash
+		}
+		if err := tx.Unscoped().Model(&models.Video{}).Where("category_id = ?", category.ID).Count(&videos).Error; err != nil {
+			return err
+		}
+		var after map[string]interface{}
+		if videos > 0 {
+			if target == nil {
+				return errCategoryInUse
+			}
+			if err := tx.Unscoped().Model(&models.Video{}).Where("category_id = ?", category.ID).Update("category_id", target.ID).Error; err != nil {
+				return err
+			}
+			after = map[string]interface{}{"reassigned_to": target.ID}
+		}
+		if err := tx.Model(&models.Category{}).Where("parent_id = ?", category.ID).Update("parent_id", category.ParentID).Error; err != nil {
+			return err
+		}
+		if err := tx.Delete(&category).Error; err != nil {
+			return err
+		}
+		return recordAudit(tx, w, r, auditRecord{
+			Action:       "category.delete",
+			ResourceType: "category",
+			ResourceID:   category.ID,
+			Before:       map[string]interface{}{"name": category.Name, "parent_id": category.ParentID, "videos": videos},
+			After:        after,
+		})
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		utils.JSONError(w, r, http.StatusNotFound, "Category not found", "not_found", "")
+		return
+	}
+	if errors.Is(err, errCategoryNameClash) {
+		utils.JSONError(w, r, http.StatusConflict, "Subcategories clash with categories under the parent", "duplicate_name",
+			"rename or move these subcategories first: "+strings.Join(clashes, ", "))
+		return
+	}
+	if errors.Is(err, errCategoryInUse) {
+		utils.JSONError(w, r, http.StatusConflict, "Category still has videos", "category_in_use",
+			strconv.FormatInt(videos, 10)+" video(s) reference it; pass reassign_to to move them")
+		return
+	}
+	if err != nil {
+		utils.JSONError(w, r, http.StatusInternalServerError, "Failed to delete category", "db_delete_failed", err.Error())
+		return
+	}
+
+	data := map[string]interface{}{"reassigned_videos": videos}
+	if target != nil {
+		data["reassigned_to"] = target.ID
+	}
+	utils.JSONSuccess(w, r, "Category deleted successfully", data)
 }
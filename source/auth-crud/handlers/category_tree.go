@@ -0,0 +1,207 @@
+package handlers
+
+import (
+	"auth-crud/config"
+	"auth-crud/models"
+	"auth-crud/utils"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"gorm.io/gorm"
+)
+
+// categoryTreeLock is the advisory lock key serializing changes to the category
+// tree, so that two concurrent moves can't close a cycle and two concurrent
+// writes can't give siblings the same name.
+const categoryTreeLock = 7_311_021
+
+// categoryDescendantsSQL selects the id of category ? and of every category below it.
+const categoryDescendantsSQL = `WITH RECURSIVE tree AS (
+		SELECT id FROM categories WHERE id = ?
+		UNION
+		SELECT c.id FROM categories c JOIN tree t ON c.parent_id = t.id
+	) SELECT id FROM tree`
+
+var (
+	errCategoryParentNotFound = errors.New("parent category not found")
+	errCategoryCycle          = errors.New("a category can't be moved below itself")
+	errCategoryNameTaken      = errors.New("a category with this name already exists under the same parent")
+)
+
+// nullableID is an optional JSON id that tells an absent field (Set is false)
+// apart from an explicit null (Set is true, ID is nil).
+type nullableID struct {
+	Set bool
+	ID  *uint
+}
+
+func (n *nullableID) UnmarshalJSON(b []byte) error {
+	n.Set = true
+	if string(b) == "null" {
+		n.ID = nil
+		return nil
+	}
+	var id uint
+	if err := json.Unmarshal(b, &id); err != nil {
+		return err
+	}
+	n.ID = &id
+	return nil
+}
+
+// CategoryNode is a category with its subcategories, as returned by GetCategoryTree.
+type CategoryNode struct {
+	ID       uint            `json:"id"`
+	Name     string          `json:"name"`
+	Children []*CategoryNode `json:"children"`
+}
+
+// checkCategoryParent verifies that parentID exists and, when an existing
+// category is being moved, that parentID is neither the category nor below it.
+// Call it inside the transaction making the change; it takes the tree lock.
+func checkCategoryParent(tx *gorm.DB, categoryID, parentID uint) error {
+	if err := lockCategoryTree(tx); err != nil {
+		return err
+	}
+	var parent models.Category
+	if err := tx.First(&parent, parentID).Error; errors.Is(err, gorm.ErrRecordNotFound) {
+		return errCategoryParentNotFound
+	} else if err != nil {
+		return err
+	}
+	if categoryID == 0 {
+		return nil
+	}
+	var below int64
+	if err := tx.Raw("SELECT COUNT(*) FROM ("+categoryDescendantsSQL+") d WHERE d.id = ?", categoryID, parentID).Scan(&below).Error; err != nil {
+		return err
+	}
+	if below > 0 {
+		return errCategoryCycle
+	}
+	return nil
+}
+
+// lockCategoryTree takes the category tree lock until the end of tx.
+func lockCategoryTree(tx *gorm.DB) error {
+	return tx.Exec("SELECT pg_advisory_xact_lock(?)", categoryTreeLock).Error
+}
+
+// categorySiblings scopes a query to the categories under parentID (the
+// top-level ones when nil).
+func categorySiblings(tx *gorm.DB, parentID *uint) *gorm.DB {
+	q := tx.Model(&models.Category{})
+	if parentID != nil {
+		return q.Where("parent_id = ?", *parentID)
+	}
+	return q.Where("parent_id IS NULL")
+}
+
+// checkCategoryName verifies that no category other than exceptID is named
+// name under parentID: names are unique among siblings only, so "Tutorials"
+// can exist below both "Go" and "Rust". Call it inside the transaction making
+// the change; it takes the tree lock.
+func checkCategoryName(tx *gorm.DB, name string, parentID *uint, exceptID uint) error {
+	if err := lockCategoryTree(tx); err != nil {
+		return err
+	}
+	var taken int64
+	if err := categorySiblings(tx, parentID).Where("name = ? AND id <> ?", name, exceptID).Count(&taken).Error; err != nil {
+		return err
+	}
+	if taken > 0 {
+		return errCategoryNameTaken
+	}
+	return nil
+}
+
+// writeCategoryTreeError writes the response for errors of checkCategoryParent
+// and checkCategoryName, reporting whether err was one of them.
+func writeCategoryTreeError(w http.ResponseWriter, r *http.Request, err error) bool {
+	switch {
+	case errors.Is(err, errCategoryNameTaken):
+		utils.JSONError(w, r, http.StatusBadRequest, "Category already exists", "duplicate_name", err.Error())
+	case errors.Is(err, errCategoryParentNotFound):
+		utils.JSONError(w, r, http.StatusBadRequest, "Invalid parent_id", "validation_error", err.Error())
+	case errors.Is(err, errCategoryCycle):
+		utils.JSONError(w, r, http.StatusBadRequest, "Invalid parent_id", "category_cycle", err.Error())
+	default:
+		return false
+	}
+	return true
+}
+
+// attachBreadcrumbs fills the Breadcrumb of each category, loading all their
+// ancestors with one recursive query.
+func attachBreadcrumbs(db *gorm.DB, categories []models.Category) error {
+	if len(categories) == 0 {
+		return nil
+	}
+	ids := make([]uint, len(categories))
+	for i, c := range categories {
+		ids[i] = c.ID
+	}
+	var nodes []models.Category
+	err := db.Raw(`WITH RECURSIVE up AS (
+			SELECT id, name, parent_id FROM categories WHERE id IN ?
+			UNION
+			SELECT c.id, c.name, c.parent_id FROM categories c JOIN up ON c.id = up.parent_id
+		) SELECT id, name, parent_id FROM up`, ids).Scan(&nodes).Error
+	if err != nil {
+		return err
+	}
+	byID := make(map[uint]models.Category, len(nodes))
+	for _, n := range nodes {
+		byID[n.ID] = n
+	}
+	for i := range categories {
+		var crumbs []models.CategoryCrumb
+		seen := map[uint]bool{}
+		for id := categories[i].ID; !seen[id]; {
+			node, ok := byID[id]
+			if !ok {
+				break
+			}
+			seen[id] = true
+			crumbs = append(crumbs, models.CategoryCrumb{ID: node.ID, Name: node.Name})
+			if node.ParentID == nil {
+				break
+			}
+			id = *node.ParentID
+		}
+		for l, r := 0, len(crumbs)-1; l < r; l, r = l+1, r-1 {
+			crumbs[l], crumbs[r] = crumbs[r], crumbs[l]
+		}
+		categories[i].Breadcrumb = crumbs
+	}
+	return nil
+}
+
+// GetCategoryTree returns every category nested under its parent, siblings sorted by name.
+func GetCategoryTree(w http.ResponseWriter, r *http.Request) {
+	var categories []models.Category
+	if err := config.DB.Order("name asc, id asc").Find(&categories).Error; err != nil {
+		utils.JSONError(w, r, http.StatusInternalServerError, "Failed to get categories", "db_query_failed", err.Error())
+		return
+	}
+
+	nodes := make(map[uint]*CategoryNode, len(categories))
+	for _, c := range categories {
+		nodes[c.ID] = &CategoryNode{ID: c.ID, Name: c.Name, Children: []*CategoryNode{}}
+	}
+	roots := []*CategoryNode{}
+	for _, c := range categories {
+		if c.ParentID != nil {
+			if parent, ok := nodes[*c.ParentID]; ok {
+				parent.Children = append(parent.Children, nodes[c.ID])
+				continue
+			}
+		}
+		roots = append(roots, nodes[c.ID])
+	}
+
+	utils.JSONSuccess(w, r, "Successfully retrieved the category tree", map[string]interface{}{
+		"items": roots,
+	})
+}
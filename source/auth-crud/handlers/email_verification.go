@@ -0,0 +1,124 @@
+package handlers
+
+import (
+	"auth-crud/config"
+	"auth-crud/loggers"
+	"auth-crud/mailer"
+	"auth-crud/models"
+	"auth-crud/utils"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Environment variables:
+// REQUIRE_EMAIL_VERIFICATION: when "true", unverified users can't log in or use their tokens
+// EMAIL_VERIFICATION_TTL: lifetime of verification links (default 48h)
+// APP_BASE_URL: public base URL used in mailed links (default http://localhost:8080)
+
+// verificationResendInterval limits how often a verification email can be re-sent.
+const verificationResendInterval = time.Minute
+
+type VerifyEmailInput struct {
+	Token string `json:"token"`
+}
+
+type ResendVerificationInput struct {
+	Email string `json:"email"`
+}
+
+// sendVerificationEmail mails a fresh verification link to the user's address.
+func sendVerificationEmail(user *models.User) error {
+	ttl := utils.DurationFromEnv("EMAIL_VERIFICATION_TTL", 48*time.Hour)
+	raw, err := createOneTimeToken(config.DB, user.ID, user.Email, purposeEmailVerification, ttl)
+	if err != nil {
+		return err
+	}
+
+	link := utils.AppURL("/api/v1/auth/verify-email?token=" + url.QueryEscape(raw))
+	return mailer.Send(mailer.Message{
+		To:      user.Email,
+		Subject: "Verify your email address",
+		Body: "Please confirm your email address by opening the link below:\n\n" + link +
+			"\n\nThe link expires in " + ttl.String() + ". If you didn't create an account, you can ignore this email.",
+	})
+}
+
+// VerifyEmail consumes a verification token, given as ?token= (mailed link) or in a JSON body.
+func VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	var input VerifyEmailInput
+	input.Token = r.URL.Query().Get("token")
+	if input.Token == "" && r.Method == http.MethodPost {
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			utils.JSONError(w, r, http.StatusBadRequest, "Invalid request body", "invalid_request", err.Error())
+			return
+		}
+	}
+	if input.Token == "" {
+		utils.JSONError(w, r, http.StatusBadRequest, "Token is required", "validation_error", "missing token")
+		return
+	}
+
+	err := config.DB.Transaction(func(tx *gorm.DB) error {
+		token, err := consumeOneTimeToken(tx, purposeEmailVerification, input.Token)
+		if err != nil {
+			return err
+		}
+		// only verify the address the link was sent to
+		res := tx.Model(&models.User{}).
+			Where("id = ? AND email = ?", token.UserID, token.Email).
+			Update("email_verified_at", time.Now())
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return errInvalidOneTimeToken
+		}
+		return nil
+	})
+	if errors.Is(err, errInvalidOneTimeToken) {
+		utils.JSONError(w, r, http.StatusBadRequest, "Invalid or expired token", "invalid_token", "")
+		return
+	}
+	if err != nil {
+		utils.JSONError(w, r, http.StatusInternalServerError, "Failed to verify email", "db_update_failed", err.Error())
+		return
+	}
+
+	utils.JSONSuccess(w, r, "Email verified successfully", nil)
+}
+
+// ResendVerification mails a new verification link. The response is the same
+// whether or not the address belongs to an unverified account.
+func ResendVerification(w http.ResponseWriter, r *http.Request) {
+	var input ResendVerificationInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		utils.JSONError(w, r, http.StatusBadRequest, "Invalid request body", "invalid_request", err.Error())
+		return
+	}
+	email := strings.TrimSpace(strings.ToLower(input.Email))
+	if email == "" {
+		utils.JSONError(w, r, http.StatusBadRequest, "Email is required", "validation_error", "missing email")
+		return
+	}
+
+	var user models.User
+	if err := config.DB.Where("email = ?", email).First(&user).Error; err == nil && user.EmailVerifiedAt == nil {
+		var recent int64
+		config.DB.Model(&models.OneTimeToken{}).
+			Where("user_id = ? AND purpose = ? AND created_at > ?", user.ID, purposeEmailVerification, time.Now().Add(-verificationResendInterval)).
+			Count(&recent)
+		if recent == 0 {
+			if err := sendVerificationEmail(&user); err != nil {
+				loggers.Error("Failed to send verification email: ", err)
+			}
+		}
+	}
+
+	utils.JSONSuccess(w, r, "If the account exists and is unverified, a verification email has been sent", nil)
+}
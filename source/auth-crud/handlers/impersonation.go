@@ -0,0 +1,102 @@
+package handlers
+
+import (
+	"auth-crud/config"
+	"auth-crud/loggers"
+	"auth-crud/middlewares"
+	"auth-crud/models"
+	"auth-crud/utils"
+	"net/http"
+	"time"
+)
+
+// ImpersonationResponse carries a token for acting as another user. There is
+// no refresh token; a new one must be requested once it expires.
+type ImpersonationResponse struct {
+	Token          string `json:"token"`
+	TokenType      string `json:"token_type"`
+	ExpiresIn      int64  `json:"expires_in"`
+	UserID         uint   `json:"user_id"`
+	ImpersonatedBy uint   `json:"impersonated_by"`
+}
+
+// outranks reports whether user holds a permission actor doesn't.
+func outranks(user, actor *models.User) bool {
+	for _, permission := range models.AllPermissions {
+		if user.HasPermission(permission) && !actor.HasPermission(permission) {
+			return true
+		}
+	}
+	return false
+}
+
+// ImpersonateUser issues a short-lived access token for a user, carrying the
+// admin in its act claim, so support staff can see the app as that user sees it.
+// Admins can't impersonate themselves or users holding permissions they lack.
+func ImpersonateUser(w http.ResponseWriter, r *http.Request) {
+	actor, ok := middlewares.GetAuthenticatedUser(r)
+	if !ok {
+		utils.JSONError(w, r, http.StatusUnauthorized, "Unauthorized", "unauthorized", "")
+		return
+	}
+	if _, ok := middlewares.GetAPIKey(r); ok {
+		utils.JSONError(w, r, http.StatusForbidden, "API keys can't impersonate users", "forbidden", "")
+		return
+	}
+	id, ok := parseUserID(w, r)
+	if !ok {
+		return
+	}
+	if id == actor.ID {
+		utils.JSONError(w, r, http.StatusBadRequest, "You can't impersonate yourself", "validation_error", "")
+		return
+	}
+
+	var user models.User
+	if err := config.DB.Preload("Roles.Permissions").First(&user, id).Error; err != nil {
+		utils.JSONError(w, r, http.StatusNotFound, "User not found", "not_found", "")
+		return
+	}
+	if user.DisabledAt != nil {
+		utils.JSONError(w, r, http.StatusBadRequest, "Disabled accounts can't be impersonated", "account_disabled", "")
+		return
+	}
+	if outranks(&user, actor) {
+		utils.JSONError(w, r, http.StatusForbidden, "You can't impersonate a user with permissions you don't have", "forbidden", "")
+		return
+	}
+
+	token, err := utils.GenerateImpersonationToken(utils.TokenSubject{UserID: user.ID, TokenVersion: user.TokenVersion, ActorID: actor.ID})
+	if err != nil {
+		utils.JSONError(w, r, http.StatusInternalServerError, "Failed to generate token", "token_failed", err.Error())
+		return
+	}
+	ttl := utils.ImpersonationTokenTTL()
+	expiresAt := time.Now().Add(ttl).UTC()
+	if err := recordAudit(config.DB, w, r, auditRecord{
+		Action:       "user.impersonate",
+		ResourceType: "user",
+		ResourceID:   user.ID,
+		After:        map[string]interface{}{"expires_at": expiresAt},
+	}); err != nil {
+		utils.JSONError(w, r, http.StatusInternalServerError, "Failed to record impersonation", "db_create_failed", err.Error())
+		return
+	}
+
+	loggers.Log(map[string]interface{}{
+		"level":      "warn",
+		"msg":        "impersonation started",
+		"request_id": utils.GetOrSetRequestID(w, r),
+		"actor_id":   actor.ID,
+		"user_id":    user.ID,
+		"expires_at": expiresAt.Format(time.RFC3339),
+	})
+
+	utils.JSONSuccess(w, r, "Impersonation token issued", ImpersonationResponse{
+		Token:          token,
+		TokenType:      "Bearer",
+		ExpiresIn:      int64(ttl.Seconds()),
+		UserID:         user.ID,
+		ImpersonatedBy: actor.ID,
+	})
+}
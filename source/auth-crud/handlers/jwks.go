@@ -0,0 +1,22 @@
+package handlers
+
+import (
+	"auth-crud/utils"
+	"encoding/json"
+	"net/http"
+)
+
+// JWKS publishes the public verification keys so other services can validate
+// our access tokens offline. It is served as a plain JWK Set rather than the
+// standard response envelope because JOSE libraries expect that exact shape.
+func JWKS(w http.ResponseWriter, r *http.Request) {
+	set, err := utils.PublicJWKS()
+	if err != nil {
+		utils.JSONError(w, r, http.StatusInternalServerError, "Failed to load signing keys", "keys_unavailable", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(set)
+}
@@ -0,0 +1,159 @@
+package handlers
+
+import (
+	"auth-crud/config"
+	"auth-crud/loggers"
+	"auth-crud/models"
+	"auth-crud/utils"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Environment variables:
+// LOGIN_MAX_ATTEMPTS: failed logins per account before it is locked (default 5)
+// LOGIN_IP_MAX_ATTEMPTS: failed logins per client IP before it is locked (default 20)
+// LOGIN_LOCKOUT_BASE: first lockout duration, doubled on every further failure (default 1m)
+// LOGIN_LOCKOUT_MAX: upper bound for a lockout (default 1h)
+// LOGIN_FAILURE_WINDOW: failures older than this are forgotten (default 1h)
+
+type throttleKey struct {
+	key         string
+	maxAttempts int
+}
+
+// dummyPasswordHash is verified against when the email is unknown, so that
+// unknown accounts take as long to reject as wrong passwords.
+var dummyPasswordHash = sync.OnceValue(func() string {
+	hashed, _ := utils.HashPassword("dummy password for timing")
+	return hashed
+})
+
+func intFromEnv(key string, def int) int {
+	if n, err := strconv.Atoi(os.Getenv(key)); err == nil && n > 0 {
+		return n
+	}
+	return def
+}
+
+func loginThrottleKeys(email, ip string) []throttleKey {
+	return []throttleKey{
+		{key: "email:" + email, maxAttempts: intFromEnv("LOGIN_MAX_ATTEMPTS", 5)},
+		{key: "ip:" + ip, maxAttempts: intFromEnv("LOGIN_IP_MAX_ATTEMPTS", 20)},
+	}
+}
+
+// loginLockedUntil returns when the latest active lockout among keys ends.
+func loginLockedUntil(keys []throttleKey) (time.Time, bool) {
+	names := make([]string, len(keys))
+	for i, k := range keys {
+		names[i] = k.key
+	}
+	var rows []models.LoginThrottle
+	config.DB.Where("key IN ? AND locked_until > ?", names, time.Now()).Find(&rows)
+
+	var until time.Time
+	for _, row := range rows {
+		if row.LockedUntil.After(until) {
+			until = *row.LockedUntil
+		}
+	}
+	return until, !until.IsZero()
+}
+
+// mfaThrottleKeys are the counters of wrong second factors: per account, which
+// a correct password doesn't reset, and per client IP.
+func mfaThrottleKeys(userID uint, ip string) []throttleKey {
+	return []throttleKey{
+		{key: "mfa:" + strconv.FormatUint(uint64(userID), 10), maxAttempts: maxMFAFailures},
+		{key: "ip:" + ip, maxAttempts: intFromEnv("LOGIN_IP_MAX_ATTEMPTS", 20)},
+	}
+}
+
+// recordLoginFailure counts a failed attempt for every key and locks keys that
+// reached their limit, with the lockout doubling on each further failure. It
+// reports whether any key is now locked.
+func recordLoginFailure(keys []throttleKey) bool {
+	window := utils.DurationFromEnv("LOGIN_FAILURE_WINDOW", time.Hour)
+	base := utils.DurationFromEnv("LOGIN_LOCKOUT_BASE", time.Minute)
+	maxLock := utils.DurationFromEnv("LOGIN_LOCKOUT_MAX", time.Hour)
+
+	locked := false
+	for _, k := range keys {
+		err := config.DB.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&models.LoginThrottle{Key: k.key}).Error; err != nil {
+				return err
+			}
+			var row models.LoginThrottle
+			if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("key = ?", k.key).First(&row).Error; err != nil {
+				return err
+			}
+
+			now := time.Now()
+			if now.Sub(row.LastFailureAt) > window {
+				row.Failures = 0
+			}
+			row.Failures++
+			row.LastFailureAt = now
+			if row.Failures >= k.maxAttempts {
+				exp := math.Min(float64(row.Failures-k.maxAttempts), 20)
+				lock := time.Duration(float64(base) * math.Pow(2, exp))
+				if lock > maxLock {
+					lock = maxLock
+				}
+				until := now.Add(lock)
+				row.LockedUntil = &until
+				locked = true
+				loggers.Log(map[string]interface{}{
+					"level":        "warn",
+					"msg":          "login locked after repeated failures",
+					"key":          k.key,
+					"failures":     row.Failures,
+					"locked_until": until.UTC().Format(time.RFC3339),
+				})
+			}
+			return tx.Save(&row).Error
+		})
+		if err != nil {
+			loggers.Error("Failed to record login failure: ", err)
+		}
+	}
+	return locked
+}
+
+// verifyCurrentPassword re-checks the password of a signed-in user before a
+// sensitive change, writing the error response when it doesn't match. Attempts
+// go through the login throttle, so that a stolen access token doesn't allow
+// unlimited guesses.
+func verifyCurrentPassword(w http.ResponseWriter, r *http.Request, user *models.User, password string) bool {
+	keys := loginThrottleKeys(user.Email, utils.ClientIP(r))
+	if until, locked := loginLockedUntil(keys); locked {
+		w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(until).Seconds())+1))
+		utils.JSONError(w, r, http.StatusTooManyRequests, "Too many failed login attempts, try again later", "too_many_attempts", "")
+		return false
+	}
+	if err := utils.VerifyPassword(password, user.Password); err != nil {
+		recordLoginFailure(keys)
+		utils.JSONError(w, r, http.StatusUnauthorized, "Invalid credentials", "invalid_credentials", "password mismatch")
+		return false
+	}
+	clearLoginFailures(user.Email)
+	return true
+}
+
+// clearLoginFailures forgets failures of an account after a successful login.
+// Per-IP counters are kept so one valid account can't reset them.
+func clearLoginFailures(email string) {
+	config.DB.Where("key = ?", "email:"+email).Delete(&models.LoginThrottle{})
+}
+
+// clearMFAFailures forgets wrong second factors of an account once one was verified.
+func clearMFAFailures(userID uint) {
+	config.DB.Where("key = ?", "mfa:"+strconv.FormatUint(uint64(userID), 10)).Delete(&models.LoginThrottle{})
+}
@@ -0,0 +1,168 @@
+package handlers
+
+import (
+	"auth-crud/config"
+	"auth-crud/loggers"
+	"auth-crud/mailer"
+	"auth-crud/models"
+	"auth-crud/utils"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Environment variables:
+// MAGIC_LINK_TTL: lifetime of sign-in links (default 15m)
+// MAGIC_LINK_URL: page that receives ?token= and posts it to the consume endpoint (default APP_BASE_URL + /magic-link)
+// MAGIC_LINK_AUTO_REGISTER: when "true", links are also sent to unknown addresses and create the account when used
+// MAGIC_LINK_MAX_PER_HOUR: sign-in links sent to one address per hour (default 5)
+
+const purposeMagicLink = "magic_link"
+
+// magicLinkRequestInterval is the minimum time between two links for one address.
+const magicLinkRequestInterval = time.Minute
+
+type MagicLinkInput struct {
+	Email string `json:"email"`
+}
+
+type ConsumeMagicLinkInput struct {
+	Token string `json:"token"`
+}
+
+// magicLinkRateLimited reports whether email already received as many links as allowed.
+func magicLinkRateLimited(email string) bool {
+	now := time.Now()
+	var recent, lastHour int64
+	config.DB.Model(&models.OneTimeToken{}).
+		Where("email = ? AND purpose = ? AND created_at > ?", email, purposeMagicLink, now.Add(-magicLinkRequestInterval)).
+		Count(&recent)
+	config.DB.Model(&models.OneTimeToken{}).
+		Where("email = ? AND purpose = ? AND created_at > ?", email, purposeMagicLink, now.Add(-time.Hour)).
+		Count(&lastHour)
+	return recent > 0 || lastHour >= int64(intFromEnv("MAGIC_LINK_MAX_PER_HOUR", 5))
+}
+
+// sendMagicLink mails a sign-in link for email. userID is 0 when the account
+// will only be created once the link is used.
+func sendMagicLink(userID uint, email string) error {
+	ttl := utils.DurationFromEnv("MAGIC_LINK_TTL", 15*time.Minute)
+	raw, err := createOneTimeToken(config.DB, userID, email, purposeMagicLink, ttl)
+	if err != nil {
+		return err
+	}
+
+	base := os.Getenv("MAGIC_LINK_URL")
+	if base == "" {
+		base = utils.AppURL("/magic-link")
+	}
+	link := base + "?token=" + url.QueryEscape(raw)
+	return mailer.Send(mailer.Message{
+		To:      email,
+		Subject: "Your sign-in link",
+		Body: "Open the link below to sign in:\n\n" + link +
+			"\n\nThe link expires in " + ttl.String() + " and can be used once. If you didn't ask for it, you can ignore this email.",
+	})
+}
+
+// RequestMagicLink mails a single-use sign-in link. Like ForgotPassword it
+// responds identically for every address and sends mail in the background.
+func RequestMagicLink(w http.ResponseWriter, r *http.Request) {
+	var input MagicLinkInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		utils.JSONError(w, r, http.StatusBadRequest, "Invalid request body", "invalid_request", err.Error())
+		return
+	}
+	email := strings.TrimSpace(strings.ToLower(input.Email))
+	if !validEmail(email) {
+		utils.JSONError(w, r, http.StatusBadRequest, "Invalid email address", "validation_error", "malformed email")
+		return
+	}
+
+	go func() {
+		var user models.User
+		if err := config.DB.Where("email = ?", email).First(&user).Error; err != nil && !utils.BoolFromEnv("MAGIC_LINK_AUTO_REGISTER") {
+			return
+		}
+		if magicLinkRateLimited(email) {
+			loggers.Log(map[string]interface{}{
+				"level": "warn",
+				"msg":   "magic link rate limited",
+				"email": email,
+			})
+			return
+		}
+		if err := sendMagicLink(user.ID, email); err != nil {
+			loggers.Error("Failed to send magic link: ", err)
+		}
+	}()
+
+	utils.JSONSuccess(w, r, "If sign-in by email is possible for this address, a link has been sent", nil)
+}
+
+// ConsumeMagicLink exchanges a sign-in link's token for the same response as
+// Login. A link sent to an unknown address creates the account. The token is
+// only accepted by POST so that link scanners fetching the mailed URL can't burn it.
+func ConsumeMagicLink(w http.ResponseWriter, r *http.Request) {
+	var input ConsumeMagicLinkInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		utils.JSONError(w, r, http.StatusBadRequest, "Invalid request body", "invalid_request", err.Error())
+		return
+	}
+	if input.Token == "" {
+		utils.JSONError(w, r, http.StatusBadRequest, "Token is required", "validation_error", "missing token")
+		return
+	}
+
+	var user models.User
+	err := config.DB.Transaction(func(tx *gorm.DB) error {
+		token, err := consumeOneTimeToken(tx, purposeMagicLink, input.Token)
+		if err != nil {
+			return err
+		}
+		if token.UserID != 0 {
+			if err := tx.First(&user, token.UserID).Error; err != nil || user.Email != token.Email {
+				return errInvalidOneTimeToken
+			}
+		} else {
+			err := tx.Where("email = ?", token.Email).First(&user).Error
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				if !utils.BoolFromEnv("MAGIC_LINK_AUTO_REGISTER") {
+					return errInvalidOneTimeToken
+				}
+				return createPasswordlessUser(tx, &user, token.Email, true)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		// the link proves ownership of the mailbox
+		if user.EmailVerifiedAt == nil {
+			now := time.Now()
+			if err := tx.Model(&models.User{}).Where("id = ?", user.ID).Update("email_verified_at", now).Error; err != nil {
+				return err
+			}
+			user.EmailVerifiedAt = &now
+		}
+		return nil
+	})
+	if errors.Is(err, errInvalidOneTimeToken) {
+		utils.JSONError(w, r, http.StatusBadRequest, "Invalid or expired token", "invalid_token", "")
+		return
+	}
+	if err != nil {
+		utils.JSONError(w, r, http.StatusInternalServerError, "Failed to sign in", "db_update_failed", err.Error())
+		return
+	}
+
+	if !accountUsable(w, r, &user) {
+		return
+	}
+	completeLogin(w, r, &user, "User logged in successfully")
+}
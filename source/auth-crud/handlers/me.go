@@ -0,0 +1,268 @@
+package handlers
+
+import (
+	"auth-crud/config"
+	"auth-crud/loggers"
+	"auth-crud/mailer"
+	"auth-crud/middlewares"
+	"auth-crud/models"
+	"auth-crud/utils"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const purposeEmailChange = "email_change"
+
+var errEmailTaken = errors.New("email already in use")
+
+type ChangePasswordInput struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+type ChangeEmailInput struct {
+	NewEmail string `json:"new_email"`
+	Password string `json:"password"`
+}
+
+type ConfirmEmailChangeInput struct {
+	Token string `json:"token"`
+}
+
+type DeleteAccountInput struct {
+	Password string `json:"password"`
+}
+
+// GetMe returns the authenticated user's own account.
+func GetMe(w http.ResponseWriter, r *http.Request) {
+	user, ok := middlewares.GetAuthenticatedUser(r)
+	if !ok {
+		utils.JSONError(w, r, http.StatusUnauthorized, "Unauthorized", "unauthorized", "")
+		return
+	}
+	resp := newUserResponse(user)
+	if actor, ok := middlewares.GetImpersonator(r); ok {
+		resp.ImpersonatedBy = &actor.ID
+	}
+	utils.JSONSuccess(w, r, "Successfully retrieved the account", resp)
+}
+
+// ChangePassword replaces the password after checking the current one. Every
+// other session is revoked; the caller receives a fresh token pair.
+func ChangePassword(w http.ResponseWriter, r *http.Request) {
+	user, ok := middlewares.GetAuthenticatedUser(r)
+	if !ok {
+		utils.JSONError(w, r, http.StatusUnauthorized, "Unauthorized", "unauthorized", "")
+		return
+	}
+	var input ChangePasswordInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		utils.JSONError(w, r, http.StatusBadRequest, "Invalid request body", "invalid_request", err.Error())
+		return
+	}
+	if input.CurrentPassword == "" || input.NewPassword == "" {
+		utils.JSONError(w, r, http.StatusBadRequest, "Current and new password are required", "validation_error", "missing current_password or new_password")
+		return
+	}
+	if !verifyCurrentPassword(w, r, user, input.CurrentPassword) {
+		return
+	}
+	if !passwordAcceptable(w, r, input.NewPassword, user.Email) {
+		return
+	}
+
+	hashed, err := utils.HashPassword(input.NewPassword)
+	if err != nil {
+		utils.JSONError(w, r, http.StatusInternalServerError, "Failed to process password", "hash_failed", err.Error())
+		return
+	}
+
+	var tokens *TokenResponse
+	err = config.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.User{}).Where("id = ?", user.ID).Update("password", hashed).Error; err != nil {
+			return err
+		}
+		if err := revokeUserSessions(tx, user.ID); err != nil {
+			return err
+		}
+		if err := recordAudit(tx, w, r, auditRecord{Action: "account.password_change", ResourceType: "user", ResourceID: user.ID}); err != nil {
+			return err
+		}
+		var updated models.User
+		if err := tx.First(&updated, user.ID).Error; err != nil {
+			return err
+		}
+		tokens, _, err = issueTokens(tx, r, &updated, "")
+		return err
+	})
+	if err != nil {
+		utils.JSONError(w, r, http.StatusInternalServerError, "Failed to change password", "db_update_failed", err.Error())
+		return
+	}
+
+	utils.JSONSuccess(w, r, "Password changed successfully; other sessions were signed out", tokens)
+}
+
+// ChangeEmail starts an email change. The address is only switched once the
+// link mailed to the new address is confirmed.
+func ChangeEmail(w http.ResponseWriter, r *http.Request) {
+	user, ok := middlewares.GetAuthenticatedUser(r)
+	if !ok {
+		utils.JSONError(w, r, http.StatusUnauthorized, "Unauthorized", "unauthorized", "")
+		return
+	}
+	var input ChangeEmailInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		utils.JSONError(w, r, http.StatusBadRequest, "Invalid request body", "invalid_request", err.Error())
+		return
+	}
+	email := strings.TrimSpace(strings.ToLower(input.NewEmail))
+	if !validEmail(email) {
+		utils.JSONError(w, r, http.StatusBadRequest, "Invalid email address", "validation_error", "malformed email")
+		return
+	}
+	if email == user.Email {
+		utils.JSONError(w, r, http.StatusBadRequest, "New email is the current email", "validation_error", "")
+		return
+	}
+	if !verifyCurrentPassword(w, r, user, input.Password) {
+		return
+	}
+	var existing models.User
+	if err := config.DB.Where("email = ?", email).First(&existing).Error; err == nil {
+		utils.JSONError(w, r, http.StatusBadRequest, "Email already in use", "duplicate_email", "email exists")
+		return
+	}
+
+	ttl := utils.DurationFromEnv("EMAIL_VERIFICATION_TTL", 48*time.Hour)
+	raw, err := createOneTimeToken(config.DB, user.ID, email, purposeEmailChange, ttl)
+	if err != nil {
+		utils.JSONError(w, r, http.StatusInternalServerError, "Failed to start email change", "db_create_failed", err.Error())
+		return
+	}
+	link := utils.AppURL("/api/v1/auth/confirm-email-change?token=" + url.QueryEscape(raw))
+	if err := mailer.Send(mailer.Message{
+		To:      email,
+		Subject: "Confirm your new email address",
+		Body:    "Open the link below to use this address for your account:\n\n" + link + "\n\nThe link expires in " + ttl.String() + ".",
+	}); err != nil {
+		utils.JSONError(w, r, http.StatusInternalServerError, "Failed to send confirmation email", "mail_failed", err.Error())
+		return
+	}
+	if err := mailer.Send(mailer.Message{
+		To:      user.Email,
+		Subject: "Your email address is being changed",
+		Body:    "A change of your account's email address to " + email + " was requested. If this wasn't you, change your password right away.",
+	}); err != nil {
+		loggers.Error("Failed to send email change notice: ", err)
+	}
+
+	utils.JSONSuccess(w, r, "Confirmation link sent to the new email address", nil)
+}
+
+// ConfirmEmailChange switches the account to the new address once its owner
+// opens the mailed link (?token=) or posts the token.
+func ConfirmEmailChange(w http.ResponseWriter, r *http.Request) {
+	var input ConfirmEmailChangeInput
+	input.Token = r.URL.Query().Get("token")
+	if input.Token == "" && r.Method == http.MethodPost {
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			utils.JSONError(w, r, http.StatusBadRequest, "Invalid request body", "invalid_request", err.Error())
+			return
+		}
+	}
+	if input.Token == "" {
+		utils.JSONError(w, r, http.StatusBadRequest, "Token is required", "validation_error", "missing token")
+		return
+	}
+
+	err := config.DB.Transaction(func(tx *gorm.DB) error {
+		token, err := consumeOneTimeToken(tx, purposeEmailChange, input.Token)
+		if err != nil {
+			return err
+		}
+		var existing models.User
+		if err := tx.Where("email = ?", token.Email).First(&existing).Error; err == nil {
+			return errEmailTaken
+		}
+		var user models.User
+		if err := tx.First(&user, token.UserID).Error; err != nil {
+			return errInvalidOneTimeToken
+		}
+		if err := tx.Model(&models.User{}).Where("id = ?", user.ID).Updates(map[string]interface{}{
+			"email":             token.Email,
+			"email_verified_at": time.Now(),
+		}).Error; err != nil {
+			return err
+		}
+		return recordAudit(tx, w, r, auditRecord{
+			Action:       "account.email_change",
+			ResourceType: "user",
+			ResourceID:   user.ID,
+			ActorID:      user.ID,
+			Before:       map[string]interface{}{"email": user.Email},
+			After:        map[string]interface{}{"email": token.Email},
+		})
+	})
+	if errors.Is(err, errInvalidOneTimeToken) {
+		utils.JSONError(w, r, http.StatusBadRequest, "Invalid or expired token", "invalid_token", "")
+		return
+	}
+	if errors.Is(err, errEmailTaken) {
+		utils.JSONError(w, r, http.StatusBadRequest, "Email already in use", "duplicate_email", "email exists")
+		return
+	}
+	if err != nil {
+		utils.JSONError(w, r, http.StatusInternalServerError, "Failed to change email", "db_update_failed", err.Error())
+		return
+	}
+
+	utils.JSONSuccess(w, r, "Email changed successfully", nil)
+}
+
+// DeleteMe permanently deletes the authenticated user's account and tokens.
+func DeleteMe(w http.ResponseWriter, r *http.Request) {
+	user, ok := middlewares.GetAuthenticatedUser(r)
+	if !ok {
+		utils.JSONError(w, r, http.StatusUnauthorized, "Unauthorized", "unauthorized", "")
+		return
+	}
+	var input DeleteAccountInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		utils.JSONError(w, r, http.StatusBadRequest, "Invalid request body", "invalid_request", err.Error())
+		return
+	}
+	if !verifyCurrentPassword(w, r, user, input.Password) {
+		return
+	}
+
+	if user.IsAdmin() {
+		var admins int64
+		config.DB.Table("user_roles").
+			Joins("JOIN roles ON roles.id = user_roles.role_id").
+			Where("roles.name = ?", models.RoleSuperadmin).
+			Count(&admins)
+		if admins <= 1 {
+			utils.JSONError(w, r, http.StatusBadRequest, "The last superadmin can't delete their account", "validation_error", "")
+			return
+		}
+	}
+
+	if err := config.DB.Transaction(func(tx *gorm.DB) error {
+		if err := recordAudit(tx, w, r, auditRecord{Action: "account.delete", ResourceType: "user", ResourceID: user.ID, Before: userAuditFields(user)}); err != nil {
+			return err
+		}
+		return deleteUserData(tx, user.ID)
+	}); err != nil {
+		utils.JSONError(w, r, http.StatusInternalServerError, "Failed to delete account", "db_delete_failed", err.Error())
+		return
+	}
+
+	utils.JSONSuccess(w, r, "Account deleted successfully", nil)
+}
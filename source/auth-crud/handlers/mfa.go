@@ -0,0 +1,360 @@
+package handlers
+
+import (
+	"auth-crud/config"
+	"auth-crud/loggers"
+	"auth-crud/middlewares"
+	"auth-crud/models"
+	"auth-crud/utils"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Environment variables:
+// TOTP_ISSUER: issuer shown in authenticator apps (default "auth-crud")
+// MFA_TOKEN_TTL: lifetime of the "mfa pending" token issued by Login (default 5m)
+// REQUIRE_ADMIN_MFA: when "true", users holding any role must enable TOTP before using admin endpoints
+
+const (
+	recoveryCodeCount = 10
+	// wrong codes allowed per account before second factors are locked out
+	// like logins (see recordLoginFailure); only a verified code resets them
+	maxMFAFailures = 5
+)
+
+var errInvalidMFACode = errors.New("invalid code")
+
+type TOTPCodeInput struct {
+	Code string `json:"code"`
+}
+
+type DisableTOTPInput struct {
+	Password     string `json:"password"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+type MFAVerifyInput struct {
+	MFAToken     string `json:"mfa_token"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+// completeLogin finishes a successful first-factor login. Users with TOTP
+// enabled receive a short-lived MFA token to exchange at /auth/mfa/verify;
+// everyone else receives their tokens right away.
+func completeLogin(w http.ResponseWriter, r *http.Request, user *models.User, message string) {
+	if user.TOTPEnabledAt != nil {
+		mfaToken, err := utils.GenerateMFAToken(utils.TokenSubject{UserID: user.ID, TokenVersion: user.TokenVersion})
+		if err != nil {
+			utils.JSONError(w, r, http.StatusInternalServerError, "Failed to generate token", "token_failed", err.Error())
+			return
+		}
+		utils.JSONSuccess(w, r, "Two-factor authentication required", map[string]interface{}{
+			"mfa_required": true,
+			"mfa_token":    mfaToken,
+		})
+		return
+	}
+
+	tokens, _, err := issueTokens(config.DB, r, user, "")
+	if err != nil {
+		utils.JSONError(w, r, http.StatusInternalServerError, "Failed to generate token", "token_failed", err.Error())
+		return
+	}
+	utils.JSONSuccess(w, r, message, tokens)
+}
+
+// checkSecondFactor validates a TOTP code (never accepting the same time step
+// twice) or consumes a recovery code.
+func checkSecondFactor(tx *gorm.DB, user *models.User, code, recoveryCode string) error {
+	if code != "" {
+		step, ok := utils.ValidateTOTP(user.TOTPSecret, code, time.Now())
+		if !ok || step <= user.TOTPLastStep {
+			return errInvalidMFACode
+		}
+		res := tx.Model(&models.User{}).
+			Where("id = ? AND totp_last_step < ?", user.ID, step).
+			Update("totp_last_step", step)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return errInvalidMFACode
+		}
+		user.TOTPLastStep = step
+		return nil
+	}
+
+	if recoveryCode != "" {
+		res := tx.Model(&models.MFARecoveryCode{}).
+			Where("user_id = ? AND code_hash = ? AND used_at IS NULL", user.ID, utils.HashToken(utils.NormalizeRecoveryCode(recoveryCode))).
+			Update("used_at", time.Now())
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return errInvalidMFACode
+		}
+		return nil
+	}
+
+	return errInvalidMFACode
+}
+
+// replaceRecoveryCodes discards the user's recovery codes and stores new ones, returning them in clear.
+func replaceRecoveryCodes(tx *gorm.DB, userID uint) ([]string, error) {
+	codes, err := utils.GenerateRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Where("user_id = ?", userID).Delete(&models.MFARecoveryCode{}).Error; err != nil {
+		return nil, err
+	}
+	rows := make([]models.MFARecoveryCode, len(codes))
+	for i, code := range codes {
+		rows[i] = models.MFARecoveryCode{UserID: userID, CodeHash: utils.HashToken(utils.NormalizeRecoveryCode(code))}
+	}
+	if err := tx.Create(&rows).Error; err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// EnrollTOTP generates a new TOTP secret for the user. Two-factor login is not
+// enforced until the secret is confirmed with a valid code.
+func EnrollTOTP(w http.ResponseWriter, r *http.Request) {
+	user, ok := middlewares.GetAuthenticatedUser(r)
+	if !ok {
+		utils.JSONError(w, r, http.StatusUnauthorized, "Unauthorized", "unauthorized", "")
+		return
+	}
+	if user.TOTPEnabledAt != nil {
+		utils.JSONError(w, r, http.StatusConflict, "Two-factor authentication is already enabled", "mfa_already_enabled", "")
+		return
+	}
+
+	secret, err := utils.GenerateTOTPSecret()
+	if err != nil {
+		utils.JSONError(w, r, http.StatusInternalServerError, "Failed to generate secret", "mfa_failed", err.Error())
+		return
+	}
+	if err := config.DB.Model(user).Omit(clause.Associations).Updates(map[string]interface{}{"totp_secret": secret, "totp_last_step": 0}).Error; err != nil {
+		utils.JSONError(w, r, http.StatusInternalServerError, "Failed to save secret", "db_update_failed", err.Error())
+		return
+	}
+
+	issuer := os.Getenv("TOTP_ISSUER")
+	if issuer == "" {
+		issuer = "auth-crud"
+	}
+	utils.JSONSuccess(w, r, "Scan the URI with an authenticator app, then confirm with a code", map[string]string{
+		"secret":      secret,
+		"otpauth_uri": utils.TOTPURI(issuer, user.Email, secret),
+	})
+}
+
+// ConfirmTOTP enables two-factor login once the user proves their authenticator
+// works, and returns recovery codes. The codes are only ever shown here.
+func ConfirmTOTP(w http.ResponseWriter, r *http.Request) {
+	user, ok := middlewares.GetAuthenticatedUser(r)
+	if !ok {
+		utils.JSONError(w, r, http.StatusUnauthorized, "Unauthorized", "unauthorized", "")
+		return
+	}
+	var input TOTPCodeInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		utils.JSONError(w, r, http.StatusBadRequest, "Invalid request body", "invalid_request", err.Error())
+		return
+	}
+	if user.TOTPEnabledAt != nil {
+		utils.JSONError(w, r, http.StatusConflict, "Two-factor authentication is already enabled", "mfa_already_enabled", "")
+		return
+	}
+	if user.TOTPSecret == "" {
+		utils.JSONError(w, r, http.StatusBadRequest, "Enroll before confirming", "mfa_not_enrolled", "")
+		return
+	}
+
+	var codes []string
+	err := config.DB.Transaction(func(tx *gorm.DB) error {
+		if err := checkSecondFactor(tx, user, input.Code, ""); err != nil {
+			return err
+		}
+		if err := tx.Model(user).Omit(clause.Associations).Update("totp_enabled_at", time.Now()).Error; err != nil {
+			return err
+		}
+		var err error
+		if codes, err = replaceRecoveryCodes(tx, user.ID); err != nil {
+			return err
+		}
+		return recordAudit(tx, w, r, auditRecord{
+			Action:       "mfa.enable",
+			ResourceType: "user",
+			ResourceID:   user.ID,
+			Before:       map[string]interface{}{"mfa_enabled": false},
+			After:        map[string]interface{}{"mfa_enabled": true},
+		})
+	})
+	if errors.Is(err, errInvalidMFACode) {
+		utils.JSONError(w, r, http.StatusBadRequest, "Invalid code", "invalid_mfa_code", "")
+		return
+	}
+	if err != nil {
+		utils.JSONError(w, r, http.StatusInternalServerError, "Failed to enable two-factor authentication", "db_update_failed", err.Error())
+		return
+	}
+
+	utils.JSONSuccess(w, r, "Two-factor authentication enabled; store the recovery codes safely", map[string]interface{}{
+		"recovery_codes": codes,
+	})
+}
+
+// DisableTOTP turns two-factor login off. It requires the password and a current
+// TOTP or recovery code.
+func DisableTOTP(w http.ResponseWriter, r *http.Request) {
+	user, ok := middlewares.GetAuthenticatedUser(r)
+	if !ok {
+		utils.JSONError(w, r, http.StatusUnauthorized, "Unauthorized", "unauthorized", "")
+		return
+	}
+	var input DisableTOTPInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		utils.JSONError(w, r, http.StatusBadRequest, "Invalid request body", "invalid_request", err.Error())
+		return
+	}
+	if user.TOTPEnabledAt == nil {
+		utils.JSONError(w, r, http.StatusBadRequest, "Two-factor authentication is not enabled", "mfa_not_enabled", "")
+		return
+	}
+	if utils.BoolFromEnv("REQUIRE_ADMIN_MFA") && len(user.Roles) > 0 {
+		utils.JSONError(w, r, http.StatusForbidden, "Two-factor authentication is required for admins", "mfa_required", "")
+		return
+	}
+	if !verifyCurrentPassword(w, r, user, input.Password) {
+		return
+	}
+
+	err := config.DB.Transaction(func(tx *gorm.DB) error {
+		if err := checkSecondFactor(tx, user, input.Code, input.RecoveryCode); err != nil {
+			return err
+		}
+		if err := tx.Model(user).Omit(clause.Associations).Updates(map[string]interface{}{
+			"totp_secret":     "",
+			"totp_enabled_at": nil,
+			"totp_last_step":  0,
+		}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", user.ID).Delete(&models.MFARecoveryCode{}).Error; err != nil {
+			return err
+		}
+		return recordAudit(tx, w, r, auditRecord{
+			Action:       "mfa.disable",
+			ResourceType: "user",
+			ResourceID:   user.ID,
+			Before:       map[string]interface{}{"mfa_enabled": true},
+			After:        map[string]interface{}{"mfa_enabled": false},
+		})
+	})
+	if errors.Is(err, errInvalidMFACode) {
+		utils.JSONError(w, r, http.StatusBadRequest, "Invalid code", "invalid_mfa_code", "")
+		return
+	}
+	if err != nil {
+		utils.JSONError(w, r, http.StatusInternalServerError, "Failed to disable two-factor authentication", "db_update_failed", err.Error())
+		return
+	}
+
+	utils.JSONSuccess(w, r, "Two-factor authentication disabled", nil)
+}
+
+// VerifyMFA completes a two-step login by exchanging the MFA token from Login
+// and a TOTP (or recovery) code for access and refresh tokens. After
+// maxMFAFailures wrong codes the account is locked out of this step for a
+// growing period and the MFA token is revoked; logging in again doesn't reset it.
+func VerifyMFA(w http.ResponseWriter, r *http.Request) {
+	var input MFAVerifyInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		utils.JSONError(w, r, http.StatusBadRequest, "Invalid request body", "invalid_request", err.Error())
+		return
+	}
+	if input.MFAToken == "" || (input.Code == "" && input.RecoveryCode == "") {
+		utils.JSONError(w, r, http.StatusBadRequest, "MFA token and code are required", "validation_error", "missing mfa_token or code")
+		return
+	}
+
+	claims, err := utils.ParseMFAToken(input.MFAToken)
+	if err != nil {
+		utils.JSONError(w, r, http.StatusUnauthorized, "Invalid MFA token", "invalid_mfa_token", err.Error())
+		return
+	}
+	var revoked int64
+	config.DB.Model(&models.RevokedToken{}).Where("jti = ?", claims.ID).Count(&revoked)
+
+	var user models.User
+	if revoked > 0 || config.DB.First(&user, claims.UserID).Error != nil ||
+		user.TokenVersion != claims.TokenVersion || user.TOTPEnabledAt == nil {
+		utils.JSONError(w, r, http.StatusUnauthorized, "Invalid MFA token", "invalid_mfa_token", "")
+		return
+	}
+	if !accountUsable(w, r, &user) {
+		return
+	}
+	keys := mfaThrottleKeys(user.ID, utils.ClientIP(r))
+	if until, locked := loginLockedUntil(keys); locked {
+		w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(until).Seconds())+1))
+		utils.JSONError(w, r, http.StatusTooManyRequests, "Too many invalid codes, try again later", "too_many_attempts", "")
+		return
+	}
+
+	err = config.DB.Transaction(func(tx *gorm.DB) error {
+		return checkSecondFactor(tx, &user, input.Code, input.RecoveryCode)
+	})
+	if errors.Is(err, errInvalidMFACode) {
+		registerMFAFailure(&user, claims, keys)
+		utils.JSONError(w, r, http.StatusUnauthorized, "Invalid code", "invalid_mfa_code", "")
+		return
+	}
+	if err != nil {
+		utils.JSONError(w, r, http.StatusInternalServerError, "Failed to verify code", "db_update_failed", err.Error())
+		return
+	}
+
+	// the MFA token is single-use
+	if err := revokeAccessToken(claims); err != nil {
+		utils.JSONError(w, r, http.StatusInternalServerError, "Failed to verify code", "db_update_failed", err.Error())
+		return
+	}
+	clearMFAFailures(user.ID)
+
+	tokens, _, err := issueTokens(config.DB, r, &user, "")
+	if err != nil {
+		utils.JSONError(w, r, http.StatusInternalServerError, "Failed to generate token", "token_failed", err.Error())
+		return
+	}
+	utils.JSONSuccess(w, r, "User logged in successfully", tokens)
+}
+
+// registerMFAFailure counts a wrong second factor and cancels the pending login
+// once it locks the account.
+func registerMFAFailure(user *models.User, claims *utils.TokenClaims, keys []throttleKey) {
+	if !recordLoginFailure(keys) {
+		return
+	}
+	if err := revokeAccessToken(claims); err != nil {
+		loggers.Error("Failed to revoke MFA token: ", err)
+	}
+	loggers.Log(map[string]interface{}{
+		"level":   "warn",
+		"msg":     "too many invalid MFA codes, pending login cancelled",
+		"user_id": user.ID,
+	})
+}
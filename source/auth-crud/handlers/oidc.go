@@ -0,0 +1,203 @@
+package handlers
+
+import (
+	"auth-crud/config"
+	"auth-crud/models"
+	"auth-crud/sso"
+	"auth-crud/utils"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	// oidcStateTTL bounds how long a user may take at the provider's login page.
+	oidcStateTTL = 10 * time.Minute
+	// oidcStateCookie binds the callback to the browser that started the login.
+	oidcStateCookie = "oidc_state"
+)
+
+var (
+	errOIDCNoEmail         = errors.New("identity has no email address")
+	errOIDCUnverifiedEmail = errors.New("email address not verified by the provider")
+	errOIDCSignupDisabled  = errors.New("no account linked to this identity")
+)
+
+func oidcCookie(r *http.Request, value string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    value,
+		Path:     "/api/v1/auth/oidc/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   r.TLS != nil || strings.HasPrefix(utils.AppURL(""), "https://"),
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// OIDCStart redirects to the provider's login page, starting an authorization
+// code flow protected by state, nonce and PKCE.
+func OIDCStart(w http.ResponseWriter, r *http.Request) {
+	provider, ok := sso.Get(r.PathValue("provider"))
+	if !ok {
+		utils.JSONError(w, r, http.StatusNotFound, "Unknown identity provider", "not_found", "")
+		return
+	}
+
+	state, err := utils.GenerateOpaqueToken()
+	if err != nil {
+		utils.JSONError(w, r, http.StatusInternalServerError, "Failed to start sign-in", "token_failed", err.Error())
+		return
+	}
+	nonce, err := utils.GenerateOpaqueToken()
+	if err != nil {
+		utils.JSONError(w, r, http.StatusInternalServerError, "Failed to start sign-in", "token_failed", err.Error())
+		return
+	}
+	verifier := sso.GenerateVerifier()
+
+	authURL, err := provider.AuthCodeURL(r.Context(), state, nonce, verifier)
+	if err != nil {
+		utils.JSONError(w, r, http.StatusBadGateway, "Identity provider unavailable", "oidc_provider_error", err.Error())
+		return
+	}
+
+	now := time.Now()
+	config.DB.Where("expires_at < ?", now).Delete(&models.OIDCLoginState{})
+	if err := config.DB.Create(&models.OIDCLoginState{
+		StateHash:    utils.HashToken(state),
+		Provider:     provider.Config.Name,
+		Nonce:        nonce,
+		CodeVerifier: verifier,
+		ExpiresAt:    now.Add(oidcStateTTL),
+	}).Error; err != nil {
+		utils.JSONError(w, r, http.StatusInternalServerError, "Failed to start sign-in", "db_create_failed", err.Error())
+		return
+	}
+
+	http.SetCookie(w, oidcCookie(r, state, int(oidcStateTTL.Seconds())))
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// OIDCCallback completes the flow: it checks the state, redeems the code,
+// verifies the ID token, links the identity to a user and logs them in.
+func OIDCCallback(w http.ResponseWriter, r *http.Request) {
+	provider, ok := sso.Get(r.PathValue("provider"))
+	if !ok {
+		utils.JSONError(w, r, http.StatusNotFound, "Unknown identity provider", "not_found", "")
+		return
+	}
+	q := r.URL.Query()
+	if e := q.Get("error"); e != "" {
+		utils.JSONError(w, r, http.StatusBadRequest, "Sign-in was not completed", "oidc_error", strings.TrimSpace(e+" "+q.Get("error_description")))
+		return
+	}
+	state, code := q.Get("state"), q.Get("code")
+	if state == "" || code == "" {
+		utils.JSONError(w, r, http.StatusBadRequest, "State and code are required", "validation_error", "missing state or code")
+		return
+	}
+
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+		utils.JSONError(w, r, http.StatusBadRequest, "Invalid or expired sign-in state", "invalid_state", "state does not match this browser")
+		return
+	}
+	http.SetCookie(w, oidcCookie(r, "", -1))
+
+	// the state is single-use
+	var pending models.OIDCLoginState
+	if err := config.DB.Where("state_hash = ?", utils.HashToken(state)).First(&pending).Error; err != nil {
+		utils.JSONError(w, r, http.StatusBadRequest, "Invalid or expired sign-in state", "invalid_state", "")
+		return
+	}
+	res := config.DB.Where("state_hash = ?", pending.StateHash).Delete(&models.OIDCLoginState{})
+	if res.Error != nil || res.RowsAffected == 0 || pending.Provider != provider.Config.Name || time.Now().After(pending.ExpiresAt) {
+		utils.JSONError(w, r, http.StatusBadRequest, "Invalid or expired sign-in state", "invalid_state", "")
+		return
+	}
+
+	identity, err := provider.Exchange(r.Context(), code, pending.CodeVerifier, pending.Nonce)
+	if err != nil {
+		utils.JSONError(w, r, http.StatusUnauthorized, "Sign-in failed", "oidc_failed", err.Error())
+		return
+	}
+
+	user, err := linkExternalIdentity(provider, identity)
+	switch {
+	case errors.Is(err, errOIDCNoEmail), errors.Is(err, errOIDCUnverifiedEmail):
+		utils.JSONError(w, r, http.StatusBadRequest, "Can't link this identity to an account", "oidc_link_failed", err.Error())
+		return
+	case errors.Is(err, errOIDCSignupDisabled):
+		utils.JSONError(w, r, http.StatusForbidden, "No account is linked to this identity", "oidc_no_account", "")
+		return
+	case err != nil:
+		utils.JSONError(w, r, http.StatusInternalServerError, "Failed to sign in", "db_update_failed", err.Error())
+		return
+	}
+
+	if !accountUsable(w, r, user) {
+		return
+	}
+	completeLogin(w, r, user, "User logged in successfully")
+}
+
+// linkExternalIdentity returns the user linked to identity. An unknown identity
+// is linked to the account with the same address, or to a newly created account
+// when the provider allows sign-up, but only if the provider verified the
+// address: otherwise anyone at the provider could claim it.
+func linkExternalIdentity(provider *sso.Provider, identity *sso.Identity) (*models.User, error) {
+	var user models.User
+	err := config.DB.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		var link models.ExternalIdentity
+		err := tx.Where("provider = ? AND subject = ?", provider.Config.Name, identity.Subject).First(&link).Error
+		if err == nil {
+			if err := tx.Model(&link).Updates(map[string]interface{}{"email": identity.Email, "last_login_at": now}).Error; err != nil {
+				return err
+			}
+			return tx.First(&user, link.UserID).Error
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+
+		if identity.Email == "" {
+			return errOIDCNoEmail
+		}
+		// only the provider's word that it checked the mailbox makes the
+		// address this person's, for an existing account as for a new one
+		if !identity.EmailVerified {
+			return errOIDCUnverifiedEmail
+		}
+		err = tx.Where("email = ?", identity.Email).First(&user).Error
+		switch {
+		case err == nil:
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			if !provider.AllowsSignup() {
+				return errOIDCSignupDisabled
+			}
+			if err := createPasswordlessUser(tx, &user, identity.Email, true); err != nil {
+				return err
+			}
+		default:
+			return err
+		}
+
+		return tx.Create(&models.ExternalIdentity{
+			UserID:      user.ID,
+			Provider:    provider.Config.Name,
+			Subject:     identity.Subject,
+			Email:       identity.Email,
+			LastLoginAt: &now,
+		}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"auth-crud/models"
+	"auth-crud/utils"
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const purposeEmailVerification = "email_verification"
+
+var errInvalidOneTimeToken = errors.New("invalid or expired token")
+
+// createOneTimeToken stores a new token for purpose and returns its raw value,
+// which is only ever sent to the user. Earlier unused tokens of the same
+// purpose are invalidated so that only the latest link works. userID is 0 for
+// a token that creates the account when used.
+func createOneTimeToken(tx *gorm.DB, userID uint, email, purpose string, ttl time.Duration) (string, error) {
+	prior := tx.Model(&models.OneTimeToken{}).Where("user_id = ? AND purpose = ? AND used_at IS NULL", userID, purpose)
+	if userID == 0 {
+		// tokens for accounts that don't exist yet are told apart by address
+		prior = prior.Where("email = ?", email)
+	}
+	if err := prior.Update("used_at", time.Now()).Error; err != nil {
+		return "", err
+	}
+
+	raw, err := utils.GenerateSignedToken(purpose)
+	if err != nil {
+		return "", err
+	}
+	token := models.OneTimeToken{
+		UserID:    userID,
+		Purpose:   purpose,
+		Email:     email,
+		TokenHash: utils.HashToken(raw),
+		ExpiresAt: time.Now().Add(ttl),
+	}
+	if err := tx.Create(&token).Error; err != nil {
+		return "", err
+	}
+	return raw, nil
+}
+
+// consumeOneTimeToken validates raw for purpose and marks it used. It fails with
+// errInvalidOneTimeToken for forged, unknown, expired or already used tokens.
+func consumeOneTimeToken(tx *gorm.DB, purpose, raw string) (*models.OneTimeToken, error) {
+	if !utils.VerifySignedToken(purpose, raw) {
+		return nil, errInvalidOneTimeToken
+	}
+
+	var token models.OneTimeToken
+	if err := tx.Where("token_hash = ? AND purpose = ?", utils.HashToken(raw), purpose).First(&token).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errInvalidOneTimeToken
+		}
+		return nil, err
+	}
+
+	now := time.Now()
+	if token.UsedAt != nil || now.After(token.ExpiresAt) {
+		return nil, errInvalidOneTimeToken
+	}
+	res := tx.Model(&models.OneTimeToken{}).Where("id = ? AND used_at IS NULL", token.ID).Update("used_at", now)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return nil, errInvalidOneTimeToken
+	}
+	token.UsedAt = &now
+	return &token, nil
+}
@@ -0,0 +1,114 @@
+package handlers
+
+import (
+	"auth-crud/utils"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// keysetPage is a request for one page of a list sorted by SortBy (id or
+// created_at), then id, in Order. Cursor is nil for the first page.
+type keysetPage struct {
+	Limit  int
+	SortBy string
+	Order  string
+	Cursor *utils.Cursor
+}
+
+// parseKeysetPage reads limit, sort_by, order and cursor, writing a 400
+// response when the cursor is invalid. A cursor carries its own sort and
+// order, which win over sort_by and order.
+func parseKeysetPage(w http.ResponseWriter, r *http.Request) (keysetPage, bool) {
+	limit, cursor, sortBy, order := utils.ParsePagination(r)
+	if sortBy != "created_at" {
+		sortBy = "id"
+	}
+	p := keysetPage{Limit: limit, SortBy: sortBy, Order: order}
+	if cursor == "" {
+		return p, true
+	}
+
+	c, err := utils.DecodeCursor(cursor)
+	valid := err == nil && (c.Order == "asc" || c.Order == "desc")
+	switch c.SortBy {
+	case "id":
+	case "created_at":
+		_, err := time.Parse(time.RFC3339Nano, c.Key)
+		valid = valid && err == nil
+	default:
+		valid = false
+	}
+	if !valid {
+		utils.JSONError(w, r, http.StatusBadRequest, "Invalid cursor", "invalid_cursor", "")
+		return p, false
+	}
+	p.SortBy, p.Order, p.Cursor = c.SortBy, c.Order, &c
+	return p, true
+}
+
+func (p keysetPage) backward() bool {
+	return p.Cursor != nil && p.Cursor.Backward
+}
+
+// apply restricts q to the items after the cursor (before it for a backward
+// cursor) in table, reading one item more than the limit to tell whether
+// another page follows. Backward pages are read in reverse order.
+func (p keysetPage) apply(q *gorm.DB, table string) *gorm.DB {
+	desc := (p.Order == "desc") != p.backward()
+	op, dir := ">", "asc"
+	if desc {
+		op, dir = "<", "desc"
+	}
+	if p.Cursor != nil {
+		if p.SortBy == "created_at" {
+			key, _ := time.Parse(time.RFC3339Nano, p.Cursor.Key)
+			q = q.Where(fmt.Sprintf("(%[1]s.created_at, %[1]s.id) %[2]s (?, ?)", table, op), key, p.Cursor.ID)
+		} else {
+			q = q.Where(fmt.Sprintf("%s.id %s ?", table, op), p.Cursor.ID)
+		}
+	}
+	if p.SortBy == "created_at" {
+		q = q.Order(table + ".created_at " + dir)
+	}
+	return q.Order(table + ".id " + dir).Limit(p.Limit + 1)
+}
+
+// pageCursors drops the extra item read by keysetPage.apply, puts a backward
+// page back in order and returns the page with the cursors of the next and
+// previous pages, empty when there is none. key returns the created_at and id
+// of an item.
+func pageCursors[T any](p keysetPage, items []T, key func(*T) (time.Time, uint)) ([]T, string, string) {
+	more := len(items) > p.Limit
+	if more {
+		items = items[:p.Limit]
+	}
+	if p.backward() {
+		slices.Reverse(items)
+	}
+	if len(items) == 0 {
+		return items, "", ""
+	}
+
+	cursorAt := func(item *T, backward bool) string {
+		createdAt, id := key(item)
+		c := utils.Cursor{SortBy: p.SortBy, Order: p.Order, ID: id, Backward: backward}
+		if p.SortBy == "created_at" {
+			c.Key = createdAt.UTC().Format(time.RFC3339Nano)
+		}
+		return utils.EncodeCursor(c)
+	}
+	next, prev := "", ""
+	// a page reached through a cursor always has the cursor's item on the
+	// side it came from
+	if more || p.backward() {
+		next = cursorAt(&items[len(items)-1], false)
+	}
+	if (more && p.backward()) || (p.Cursor != nil && !p.backward()) {
+		prev = cursorAt(&items[0], true)
+	}
+	return items, next, prev
+}
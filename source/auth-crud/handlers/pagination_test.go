@@ -0,0 +1,161 @@
+package handlers
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+type pageItem struct {
+	ID        uint
+	CreatedAt time.Time
+}
+
+func pageItemKey(it *pageItem) (time.Time, uint) {
+	return it.CreatedAt, it.ID
+}
+
+// fetchPage does in memory what keysetPage.apply does in SQL.
+func fetchPage(p keysetPage, all []pageItem) []pageItem {
+	less := func(a, b pageItem) bool {
+		if p.SortBy == "created_at" && !a.CreatedAt.Equal(b.CreatedAt) {
+			return a.CreatedAt.Before(b.CreatedAt)
+		}
+		return a.ID < b.ID
+	}
+	desc := (p.Order == "desc") != p.backward()
+	sorted := slices.Clone(all)
+	slices.SortFunc(sorted, func(a, b pageItem) int {
+		switch {
+		case less(a, b) == less(b, a):
+			return 0
+		case less(a, b) != desc:
+			return -1
+		default:
+			return 1
+		}
+	})
+
+	var items []pageItem
+	for _, it := range sorted {
+		if p.Cursor != nil {
+			at := pageItem{ID: p.Cursor.ID}
+			at.CreatedAt, _ = time.Parse(time.RFC3339Nano, p.Cursor.Key)
+			if after := less(at, it); after == desc || (!less(at, it) && !less(it, at)) {
+				continue
+			}
+		}
+		items = append(items, it)
+		if len(items) == p.Limit+1 {
+			break
+		}
+	}
+	return items
+}
+
+// requestPage parses the page of a list request like a handler and returns it
+// with the next and previous cursors.
+func requestPage(t *testing.T, all []pageItem, limit int, sortBy, order, cursor string) ([]uint, string, string) {
+	t.Helper()
+	q := url.Values{"limit": {strconv.Itoa(limit)}, "sort_by": {sortBy}, "order": {order}}
+	if cursor != "" {
+		q.Set("cursor", cursor)
+	}
+	w := httptest.NewRecorder()
+	p, ok := parseKeysetPage(w, httptest.NewRequest("GET", "/?"+q.Encode(), nil))
+	if !ok {
+		t.Fatalf("cursor rejected: %s", w.Body)
+	}
+	items, next, prev := pageCursors(p, fetchPage(p, all), pageItemKey)
+	ids := make([]uint, len(items))
+	for i, it := range items {
+		ids[i] = it.ID
+	}
+	return ids, next, prev
+}
+
+func TestPageCursors(t *testing.T) {
+	t.Setenv("TOKEN_SIGNING_SECRET", "test")
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	list := func(n int) []pageItem {
+		items := make([]pageItem, n)
+		for i := range items {
+			// created_at runs against the ids, so that the sort column matters
+			items[i] = pageItem{ID: uint(i + 1), CreatedAt: base.Add(time.Duration(n-i) * time.Minute)}
+		}
+		return items
+	}
+
+	tests := []struct {
+		name   string
+		n      int
+		limit  int
+		sortBy string
+		order  string
+		want   [][]uint
+	}{
+		{"empty", 0, 2, "id", "asc", [][]uint{{}}},
+		{"single page", 2, 2, "id", "asc", [][]uint{{1, 2}}},
+		{"partial last page", 5, 2, "id", "asc", [][]uint{{1, 2}, {3, 4}, {5}}},
+		{"full last page", 4, 2, "id", "asc", [][]uint{{1, 2}, {3, 4}}},
+		{"descending", 5, 2, "id", "desc", [][]uint{{5, 4}, {3, 2}, {1}}},
+		{"by created_at", 5, 2, "created_at", "asc", [][]uint{{5, 4}, {3, 2}, {1}}},
+		{"by created_at descending", 5, 3, "created_at", "desc", [][]uint{{1, 2, 3}, {4, 5}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			all := list(tt.n)
+
+			// forward from the first page: no previous page at the start, no
+			// next page at the end
+			var prevs []string
+			cursor := ""
+			for i, want := range tt.want {
+				ids, next, prev := requestPage(t, all, tt.limit, tt.sortBy, tt.order, cursor)
+				if !slices.Equal(ids, want) {
+					t.Fatalf("forward page %d = %v, want %v", i, ids, want)
+				}
+				if (prev == "") != (i == 0) {
+					t.Errorf("forward page %d: prev_cursor %q", i, prev)
+				}
+				if (next == "") != (i == len(tt.want)-1) {
+					t.Errorf("forward page %d: next_cursor %q", i, next)
+				}
+				prevs = append(prevs, prev)
+				cursor = next
+			}
+
+			// backward from the last page down to the first one, which has
+			// no previous page again
+			cursor = prevs[len(prevs)-1]
+			for i := len(tt.want) - 2; i >= 0; i-- {
+				ids, next, prev := requestPage(t, all, tt.limit, tt.sortBy, tt.order, cursor)
+				if !slices.Equal(ids, tt.want[i]) {
+					t.Fatalf("backward page %d = %v, want %v", i, ids, tt.want[i])
+				}
+				if (prev == "") != (i == 0) {
+					t.Errorf("backward page %d: prev_cursor %q", i, prev)
+				}
+				if next == "" {
+					t.Errorf("backward page %d: no next_cursor", i)
+				}
+				cursor = prev
+			}
+		})
+	}
+}
+
+func TestParseKeysetPageRejectsInvalidCursors(t *testing.T) {
+	t.Setenv("TOKEN_SIGNING_SECRET", "test")
+	_, next, _ := pageCursors(keysetPage{Limit: 1, SortBy: "id", Order: "asc"}, []pageItem{{ID: 1}, {ID: 2}}, pageItemKey)
+
+	for _, cursor := range []string{"42", "garbage.sig", next + "x"} {
+		w := httptest.NewRecorder()
+		if _, ok := parseKeysetPage(w, httptest.NewRequest("GET", "/?cursor="+url.QueryEscape(cursor), nil)); ok || w.Code != 400 {
+			t.Errorf("cursor %q: ok = %v, status %d", cursor, ok, w.Code)
+		}
+	}
+}
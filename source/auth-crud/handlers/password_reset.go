@@ -0,0 +1,164 @@
+package handlers
+
+import (
+	"auth-crud/config"
+	"auth-crud/loggers"
+	"auth-crud/mailer"
+	"auth-crud/models"
+	"auth-crud/utils"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Environment variables:
+// PASSWORD_RESET_TTL: lifetime of reset links (default 1h)
+// PASSWORD_RESET_URL: page that receives ?token= (default APP_BASE_URL + /reset-password)
+
+const purposePasswordReset = "password_reset"
+
+// resetRequestInterval limits how often reset emails are sent for one account.
+const resetRequestInterval = time.Minute
+
+type ForgotPasswordInput struct {
+	Email string `json:"email"`
+}
+
+type ResetPasswordInput struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+func sendPasswordResetEmail(user *models.User) error {
+	ttl := utils.DurationFromEnv("PASSWORD_RESET_TTL", time.Hour)
+	raw, err := createOneTimeToken(config.DB, user.ID, user.Email, purposePasswordReset, ttl)
+	if err != nil {
+		return err
+	}
+
+	base := os.Getenv("PASSWORD_RESET_URL")
+	if base == "" {
+		base = utils.AppURL("/reset-password")
+	}
+	link := base + "?token=" + url.QueryEscape(raw)
+	return mailer.Send(mailer.Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: "Someone asked to reset the password of your account. Open the link below to choose a new one:\n\n" + link +
+			"\n\nThe link expires in " + ttl.String() + " and can be used once. If this wasn't you, you can ignore this email.",
+	})
+}
+
+// ForgotPassword mails a password reset link. It responds identically whether
+// or not the email belongs to an account, and sends mail in the background so
+// response times don't reveal it either.
+func ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	var input ForgotPasswordInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		utils.JSONError(w, r, http.StatusBadRequest, "Invalid request body", "invalid_request", err.Error())
+		return
+	}
+	email := strings.TrimSpace(strings.ToLower(input.Email))
+	if email == "" {
+		utils.JSONError(w, r, http.StatusBadRequest, "Email is required", "validation_error", "missing email")
+		return
+	}
+
+	go func() {
+		var user models.User
+		if err := config.DB.Where("email = ?", email).First(&user).Error; err != nil {
+			return
+		}
+		var recent int64
+		config.DB.Model(&models.OneTimeToken{}).
+			Where("user_id = ? AND purpose = ? AND created_at > ?", user.ID, purposePasswordReset, time.Now().Add(-resetRequestInterval)).
+			Count(&recent)
+		if recent > 0 {
+			return
+		}
+		if err := sendPasswordResetEmail(&user); err != nil {
+			loggers.Error("Failed to send password reset email: ", err)
+		}
+	}()
+
+	utils.JSONSuccess(w, r, "If an account exists for this email, a password reset link has been sent", nil)
+}
+
+// ResetPassword sets a new password using a reset token and revokes every
+// existing session of the user.
+func ResetPassword(w http.ResponseWriter, r *http.Request) {
+	var input ResetPasswordInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		utils.JSONError(w, r, http.StatusBadRequest, "Invalid request body", "invalid_request", err.Error())
+		return
+	}
+	if input.Token == "" || input.Password == "" {
+		utils.JSONError(w, r, http.StatusBadRequest, "Token and password are required", "validation_error", "missing token or password")
+		return
+	}
+
+	// forged tokens are turned away before any database or hashing work
+	if !utils.VerifySignedToken(purposePasswordReset, input.Token) {
+		utils.JSONError(w, r, http.StatusBadRequest, "Invalid or expired token", "invalid_token", "")
+		return
+	}
+
+	var errHash error
+	err := config.DB.Transaction(func(tx *gorm.DB) error {
+		token, err := consumeOneTimeToken(tx, purposePasswordReset, input.Token)
+		if err != nil {
+			return err
+		}
+		var user models.User
+		if err := tx.First(&user, token.UserID).Error; err != nil || user.Email != token.Email {
+			return errInvalidOneTimeToken
+		}
+		if reasons := utils.ValidatePassword(input.Password, user.Email); len(reasons) > 0 {
+			return &weakPasswordError{reasons: reasons}
+		}
+		// hashed only once the token and the password are known to be good
+		hashed, err := utils.HashPassword(input.Password)
+		if err != nil {
+			errHash = err
+			return err
+		}
+
+		updates := map[string]interface{}{"password": hashed}
+		// the link proves ownership of the mailbox
+		if user.EmailVerifiedAt == nil {
+			updates["email_verified_at"] = time.Now()
+		}
+		if err := tx.Model(&user).Updates(updates).Error; err != nil {
+			return err
+		}
+		if err := revokeUserSessions(tx, user.ID); err != nil {
+			return err
+		}
+		return recordAudit(tx, w, r, auditRecord{Action: "account.password_reset", ResourceType: "user", ResourceID: user.ID, ActorID: user.ID})
+	})
+	if errors.Is(err, errInvalidOneTimeToken) {
+		utils.JSONError(w, r, http.StatusBadRequest, "Invalid or expired token", "invalid_token", "")
+		return
+	}
+	var weak *weakPasswordError
+	if errors.As(err, &weak) {
+		writeWeakPassword(w, r, weak)
+		return
+	}
+	if errHash != nil {
+		utils.JSONError(w, r, http.StatusInternalServerError, "Failed to process password", "hash_failed", errHash.Error())
+		return
+	}
+	if err != nil {
+		utils.JSONError(w, r, http.StatusInternalServerError, "Failed to reset password", "db_update_failed", err.Error())
+		return
+	}
+
+	utils.JSONSuccess(w, r, "Password reset successfully", nil)
+}
@@ -0,0 +1,164 @@
+package handlers
+
+import (
+	"auth-crud/config"
+	"auth-crud/models"
+	"auth-crud/utils"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// searchHitsSQL ranks the live videos matching the tsquery ?. The matches are
+// ranked first and the snippets built only for the returned page. The title is
+// HTML-escaped before ts_headline so that <mark> is the only markup in a snippet.
+const searchHitsSQL = `SELECT hits.id, hits.rank,
+		ts_headline('` + models.VideoSearchConfig + `', ` + escapedTitleSQL + `, hits.query, 'StartSel=<mark>, StopSel=</mark>, HighlightAll=true') AS snippet
+	FROM (
+		SELECT v.id, q.query, ts_rank(v.search_vector, q.query) AS rank
+		FROM videos v, to_tsquery('` + models.VideoSearchConfig + `', ?) AS q(query)
+		WHERE v.search_vector @@ q.query AND v.deleted_at IS NULL
+	) hits JOIN videos ON videos.id = hits.id`
+
+// escapedTitleSQL is videos.title with &, <, >, " and ' replaced by HTML entities.
+const escapedTitleSQL = `replace(replace(replace(replace(replace(videos.title, '&', '&amp;'), '<', '&lt;'), '>', '&gt;'), '"', '&quot;'), '''', '&#39;')`
+
+// SearchResult is a video matching a search, with its relevance and its
+// HTML-escaped title with the matched words wrapped in <mark>.
+type SearchResult struct {
+	Video   models.Video `json:"video"`
+	Rank    float32      `json:"rank"`
+	Snippet string       `json:"snippet"`
+}
+
+type searchHit struct {
+	ID      uint
+	Rank    float32
+	Snippet string
+}
+
+// prefixQuery turns free text into a tsquery matching videos that contain
+// every word, each as a prefix: "intro go" becomes "intro:* & go:*". Only
+// letters and digits are kept, so the result is always a valid tsquery.
+func prefixQuery(text string) string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(c rune) bool {
+		return !unicode.IsLetter(c) && !unicode.IsDigit(c)
+	})
+	for i, word := range words {
+		words[i] = word + ":*"
+	}
+	return strings.Join(words, " & ")
+}
+
+// parseSearchCursor reads a cursor built by searchCursor: a utils.Cursor sorted
+// by rank, whose key is the rank of the hit at the position.
+func parseSearchCursor(cursor string) (utils.Cursor, float32, bool) {
+	c, err := utils.DecodeCursor(cursor)
+	if err != nil || c.SortBy != "rank" {
+		return c, 0, false
+	}
+	rank, err := strconv.ParseFloat(c.Key, 32)
+	if err != nil {
+		return c, 0, false
+	}
+	return c, float32(rank), true
+}
+
+func searchCursor(hit searchHit, backward bool) string {
+	return utils.EncodeCursor(utils.Cursor{
+		SortBy:   "rank",
+		Order:    "desc",
+		Key:      strconv.FormatFloat(float64(hit.Rank), 'g', -1, 32),
+		ID:       hit.ID,
+		Backward: backward,
+	})
+}
+
+// SearchVideos is the full-text search over videos: ?q= matches word prefixes,
+// results come by descending relevance with ties broken by descending id, and
+// the cursors carry both so that pages never skip or repeat a video. Paging
+// follows keysetPage: one hit more than the limit is read to tell whether
+// another page follows, and backward pages are read in reverse order.
+func SearchVideos(w http.ResponseWriter, r *http.Request) {
+	limit, cursor, _, _ := utils.ParsePagination(r)
+	tsquery := prefixQuery(r.URL.Query().Get("q"))
+	if tsquery == "" {
+		utils.JSONError(w, r, http.StatusBadRequest, "Missing search query", "validation_error", "q must contain at least one letter or digit")
+		return
+	}
+
+	sql := searchHitsSQL
+	args := []interface{}{tsquery}
+	backward, paged := false, cursor != ""
+	op, dir := "<", "DESC"
+	if paged {
+		c, rank, ok := parseSearchCursor(cursor)
+		if !ok {
+			utils.JSONError(w, r, http.StatusBadRequest, "Invalid cursor", "invalid_cursor", "")
+			return
+		}
+		backward = c.Backward
+		if backward {
+			op, dir = ">", "ASC"
+		}
+		sql += " WHERE (hits.rank, hits.id) " + op + " (?, ?)"
+		args = append(args, rank, c.ID)
+	}
+	sql += " ORDER BY hits.rank " + dir + ", hits.id " + dir + " LIMIT ?"
+	args = append(args, limit+1)
+
+	var hits []searchHit
+	if err := config.DB.Raw(sql, args...).Scan(&hits).Error; err != nil {
+		utils.JSONError(w, r, http.StatusInternalServerError, "Failed to search videos", "db_query_failed", err.Error())
+		return
+	}
+	more := len(hits) > limit
+	if more {
+		hits = hits[:limit]
+	}
+	if backward {
+		slices.Reverse(hits)
+	}
+
+	ids := make([]uint, len(hits))
+	for i, hit := range hits {
+		ids[i] = hit.ID
+	}
+	var videos []models.Video
+	if len(ids) > 0 {
+		if err := config.DB.Preload("Category").Where("id IN ?", ids).Find(&videos).Error; err != nil {
+			utils.JSONError(w, r, http.StatusInternalServerError, "Failed to search videos", "db_query_failed", err.Error())
+			return
+		}
+	}
+	byID := make(map[uint]models.Video, len(videos))
+	for _, v := range videos {
+		byID[v.ID] = v
+	}
+
+	items := make([]SearchResult, 0, len(hits))
+	for _, hit := range hits {
+		// a video trashed between the two queries is left out
+		if video, ok := byID[hit.ID]; ok {
+			items = append(items, SearchResult{Video: video, Rank: hit.Rank, Snippet: hit.Snippet})
+		}
+	}
+	// the cursors follow the rules of pageCursors
+	nextCursor, prevCursor := "", ""
+	if len(hits) > 0 {
+		if more || backward {
+			nextCursor = searchCursor(hits[len(hits)-1], false)
+		}
+		if (more && backward) || (paged && !backward) {
+			prevCursor = searchCursor(hits[0], true)
+		}
+	}
+
+	utils.JSONSuccess(w, r, "Successfully searched the videos", map[string]interface{}{
+		"items":       items,
+		"next_cursor": nextCursor,
+		"prev_cursor": prevCursor,
+	})
+}
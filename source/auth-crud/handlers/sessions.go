@@ -0,0 +1,132 @@
+package handlers
+
+import (
+	"auth-crud/config"
+	"auth-crud/middlewares"
+	"auth-crud/models"
+	"auth-crud/utils"
+	"net/http"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// SessionResponse describes one logged-in device. Current marks the session
+// the request itself was made with.
+type SessionResponse struct {
+	ID         string    `json:"id"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	Current    bool      `json:"current"`
+}
+
+// truncate shortens s to at most n bytes without splitting a UTF-8 sequence.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return strings.ToValidUTF8(s[:n], "")
+}
+
+// activeSessions returns the user's sessions that are neither revoked nor expired,
+// most recently used first.
+func activeSessions(userID uint) ([]models.Session, error) {
+	var sessions []models.Session
+	err := config.DB.
+		Where("user_id = ? AND revoked_at IS NULL AND expires_at > ?", userID, time.Now()).
+		Order("last_seen_at desc").
+		Find(&sessions).Error
+	return sessions, err
+}
+
+func newSessionResponses(sessions []models.Session, currentID string) []SessionResponse {
+	items := make([]SessionResponse, len(sessions))
+	for i, s := range sessions {
+		items[i] = SessionResponse{
+			ID:         s.ID,
+			UserAgent:  s.UserAgent,
+			IP:         s.IP,
+			CreatedAt:  s.CreatedAt,
+			LastSeenAt: s.LastSeenAt,
+			ExpiresAt:  s.ExpiresAt,
+			Current:    currentID != "" && s.ID == currentID,
+		}
+	}
+	return items
+}
+
+// ListSessions lists the devices the authenticated user is logged in on.
+func ListSessions(w http.ResponseWriter, r *http.Request) {
+	user, ok := middlewares.GetAuthenticatedUser(r)
+	if !ok {
+		utils.JSONError(w, r, http.StatusUnauthorized, "Unauthorized", "unauthorized", "")
+		return
+	}
+	sessions, err := activeSessions(user.ID)
+	if err != nil {
+		utils.JSONError(w, r, http.StatusInternalServerError, "Failed to get sessions", "db_query_failed", err.Error())
+		return
+	}
+	currentID := ""
+	if claims, ok := middlewares.GetTokenClaims(r); ok {
+		currentID = claims.SessionID
+	}
+	utils.JSONSuccess(w, r, "Successfully retrieved the sessions", map[string]interface{}{
+		"items": newSessionResponses(sessions, currentID),
+	})
+}
+
+// RevokeSession signs one of the authenticated user's devices out. Its refresh
+// token stops working and its access tokens are rejected from then on.
+func RevokeSession(w http.ResponseWriter, r *http.Request) {
+	user, ok := middlewares.GetAuthenticatedUser(r)
+	if !ok {
+		utils.JSONError(w, r, http.StatusUnauthorized, "Unauthorized", "unauthorized", "")
+		return
+	}
+	var session models.Session
+	if err := config.DB.Where("id = ? AND user_id = ? AND revoked_at IS NULL", r.PathValue("id"), user.ID).First(&session).Error; err != nil {
+		utils.JSONError(w, r, http.StatusNotFound, "Session not found", "not_found", "")
+		return
+	}
+	if err := config.DB.Transaction(func(tx *gorm.DB) error {
+		if err := revokeSession(tx, user.ID, session.ID); err != nil {
+			return err
+		}
+		return recordAudit(tx, w, r, auditRecord{
+			Action:       "session.revoke",
+			ResourceType: "session",
+			ResourceID:   session.ID,
+			Before:       map[string]interface{}{"user_agent": session.UserAgent, "ip": session.IP},
+		})
+	}); err != nil {
+		utils.JSONError(w, r, http.StatusInternalServerError, "Failed to revoke session", "db_update_failed", err.Error())
+		return
+	}
+	utils.JSONSuccess(w, r, "Session revoked successfully", nil)
+}
+
+// ListUserSessions lists the devices a user is logged in on (admin).
+func ListUserSessions(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseUserID(w, r)
+	if !ok {
+		return
+	}
+	var user models.User
+	if err := config.DB.First(&user, id).Error; err != nil {
+		utils.JSONError(w, r, http.StatusNotFound, "User not found", "not_found", "")
+		return
+	}
+	sessions, err := activeSessions(user.ID)
+	if err != nil {
+		utils.JSONError(w, r, http.StatusInternalServerError, "Failed to get sessions", "db_query_failed", err.Error())
+		return
+	}
+	utils.JSONSuccess(w, r, "Successfully retrieved the sessions", map[string]interface{}{
+		"items": newSessionResponses(sessions, ""),
+	})
+}
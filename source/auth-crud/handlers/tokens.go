@@ -0,0 +1,172 @@
+package handlers
+
+import (
+	"auth-crud/config"
+	"auth-crud/loggers"
+	"auth-crud/models"
+	"auth-crud/utils"
+	"errors"
+	"net/http"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var errRefreshTokenReused = errors.New("refresh token reused")
+
+// TokenResponse is returned whenever a client is issued credentials.
+// "token" is kept for clients written against the original login response.
+type TokenResponse struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+}
+
+// issueTokens creates an access token and a refresh token for the user.
+// A new token family, and with it a new session for the requesting device, is
+// started when familyID is empty; otherwise the family's session is refreshed.
+func issueTokens(tx *gorm.DB, r *http.Request, user *models.User, familyID string) (*TokenResponse, *models.RefreshToken, error) {
+	now := time.Now()
+	expiresAt := now.Add(utils.RefreshTokenTTL())
+	if familyID == "" {
+		familyID = utils.RandomID()
+	}
+	// upsert, so that families started before sessions existed get one on refresh
+	session := models.Session{
+		ID:         familyID,
+		UserID:     user.ID,
+		UserAgent:  truncate(r.UserAgent(), 512),
+		IP:         utils.ClientIP(r),
+		LastSeenAt: now,
+		ExpiresAt:  expiresAt,
+	}
+	if err := tx.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"ip", "last_seen_at", "expires_at"}),
+	}).Create(&session).Error; err != nil {
+		return nil, nil, err
+	}
+
+	access, err := utils.GenerateToken(utils.TokenSubject{UserID: user.ID, TokenVersion: user.TokenVersion, SessionID: familyID})
+	if err != nil {
+		return nil, nil, err
+	}
+	raw, err := utils.GenerateOpaqueToken()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	refresh := models.RefreshToken{
+		UserID:    user.ID,
+		FamilyID:  familyID,
+		TokenHash: utils.HashToken(raw),
+		ExpiresAt: expiresAt,
+	}
+	if err := tx.Create(&refresh).Error; err != nil {
+		return nil, nil, err
+	}
+
+	return &TokenResponse{
+		Token:        access,
+		RefreshToken: raw,
+		TokenType:    "Bearer",
+		ExpiresIn:    int64(utils.AccessTokenTTL().Seconds()),
+	}, &refresh, nil
+}
+
+// rotateRefreshToken revokes current and issues its successor in the same family.
+// errRefreshTokenReused is returned when current was already consumed concurrently.
+func rotateRefreshToken(r *http.Request, user *models.User, current *models.RefreshToken) (*TokenResponse, error) {
+	var tokens *TokenResponse
+	err := config.DB.Transaction(func(tx *gorm.DB) error {
+		res := tx.Model(&models.RefreshToken{}).
+			Where("id = ? AND revoked_at IS NULL", current.ID).
+			Update("revoked_at", time.Now())
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return errRefreshTokenReused
+		}
+
+		issued, next, err := issueTokens(tx, r, user, current.FamilyID)
+		if err != nil {
+			return err
+		}
+		tokens = issued
+		return tx.Model(&models.RefreshToken{}).Where("id = ?", current.ID).Update("replaced_by_id", next.ID).Error
+	})
+	return tokens, err
+}
+
+// revokeRefreshFamily revokes every still-active token of a family and its
+// session. It is called when a rotated token is presented again, which means
+// the family has leaked.
+func revokeRefreshFamily(familyID string, userID uint) {
+	if err := revokeSession(config.DB, userID, familyID); err != nil {
+		loggers.Error("Failed to revoke refresh token family: ", err)
+	}
+	loggers.Log(map[string]interface{}{
+		"level":     "warn",
+		"msg":       "refresh token reuse detected, family revoked",
+		"user_id":   userID,
+		"family_id": familyID,
+	})
+}
+
+// revokeAccessToken puts an access token's jti on the deny-list until it expires.
+func revokeAccessToken(claims *utils.TokenClaims) error {
+	// opportunistically drop entries for tokens that have expired by now
+	config.DB.Where("expires_at < ?", time.Now()).Delete(&models.RevokedToken{})
+
+	return config.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(&models.RevokedToken{
+		JTI:       claims.ID,
+		UserID:    claims.UserID,
+		ExpiresAt: claims.ExpiresAt,
+	}).Error
+}
+
+// revokeSession ends one session of the user: its refresh tokens are revoked and
+// RequireAuth stops accepting access tokens issued for it.
+func revokeSession(tx *gorm.DB, userID uint, sessionID string) error {
+	now := time.Now()
+	if err := tx.Model(&models.Session{}).
+		Where("id = ? AND user_id = ? AND revoked_at IS NULL", sessionID, userID).
+		Update("revoked_at", now).Error; err != nil {
+		return err
+	}
+	return tx.Model(&models.RefreshToken{}).
+		Where("family_id = ? AND user_id = ? AND revoked_at IS NULL", sessionID, userID).
+		Update("revoked_at", now).Error
+}
+
+// revokeUserSessions invalidates every token issued to the user by bumping
+// their token version and revoking all refresh tokens and sessions. It backs
+// password changes and resets, logout-all and disabling an account; API keys
+// are left alone (see revokeUserAPIKeys).
+func revokeUserSessions(tx *gorm.DB, userID uint) error {
+	now := time.Now()
+	if err := tx.Model(&models.User{}).Where("id = ?", userID).
+		Update("token_version", gorm.Expr("token_version + 1")).Error; err != nil {
+		return err
+	}
+	if err := tx.Model(&models.Session{}).
+		Where("user_id = ? AND revoked_at IS NULL", userID).
+		Update("revoked_at", now).Error; err != nil {
+		return err
+	}
+	return tx.Model(&models.RefreshToken{}).
+		Where("user_id = ? AND revoked_at IS NULL", userID).
+		Update("revoked_at", now).Error
+}
+
+// revokeUserAPIKeys revokes the user's API keys when an admin disables the
+// account. Password changes and logout-all keep them, so that machine clients
+// survive routine credential changes.
+func revokeUserAPIKeys(tx *gorm.DB, userID uint) error {
+	return tx.Model(&models.APIKey{}).
+		Where("user_id = ? AND revoked_at IS NULL", userID).
+		Update("revoked_at", time.Now()).Error
+}
@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"auth-crud/config"
 	"fmt"
 	"io"
 	"net/http"
@@ -39,11 +40,24 @@ func UploadFile(w http.ResponseWriter, r *http.Request) {
 	}
 	defer out.Close()
 
-	if _, err := io.Copy(out, file); err != nil {
+	size, err := io.Copy(out, file)
+	if err != nil {
 		http.Error(w, "failed to write file", http.StatusInternalServerError)
 		return
 	}
 
+	if err := recordAudit(config.DB, w, r, auditRecord{
+		Action:       "upload.create",
+		ResourceType: "upload",
+		ResourceID:   name,
+		After:        map[string]interface{}{"path": path, "filename": header.Filename, "size": size},
+	}); err != nil {
+		out.Close()
+		os.Remove(path)
+		http.Error(w, "failed to record upload", http.StatusInternalServerError)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
 	_, _ = w.Write([]byte(fmt.Sprintf(`{"path":"%s"}`, path)))
@@ -0,0 +1,289 @@
+package handlers
+
+import (
+	"auth-crud/config"
+	"auth-crud/middlewares"
+	"auth-crud/models"
+	"auth-crud/utils"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// UserResponse is the admin view of an account. It never includes secrets.
+// ImpersonatedBy is only set by GetMe, for requests made with an impersonation token.
+type UserResponse struct {
+	ID             uint       `json:"id"`
+	Email          string     `json:"email"`
+	EmailVerified  bool       `json:"email_verified"`
+	MFAEnabled     bool       `json:"mfa_enabled"`
+	IsAdmin        bool       `json:"is_admin"`
+	Roles          []string   `json:"roles"`
+	Disabled       bool       `json:"disabled"`
+	DisabledAt     *time.Time `json:"disabled_at,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	ImpersonatedBy *uint      `json:"impersonated_by,omitempty"`
+}
+
+// UpdateUserInput is a partial update; omitted fields are left unchanged.
+// Roles, when given, replaces the user's roles; IsAdmin grants or revokes superadmin.
+type UpdateUserInput struct {
+	IsAdmin  *bool     `json:"is_admin"`
+	Disabled *bool     `json:"disabled"`
+	Roles    *[]string `json:"roles"`
+}
+
+func newUserResponse(user *models.User) UserResponse {
+	roles := make([]string, 0, len(user.Roles))
+	for _, role := range user.Roles {
+		roles = append(roles, role.Name)
+	}
+	return UserResponse{
+		ID:            user.ID,
+		Email:         user.Email,
+		EmailVerified: user.EmailVerifiedAt != nil,
+		MFAEnabled:    user.TOTPEnabledAt != nil,
+		IsAdmin:       user.IsAdmin(),
+		Roles:         roles,
+		Disabled:      user.DisabledAt != nil,
+		DisabledAt:    user.DisabledAt,
+		CreatedAt:     user.CreatedAt,
+	}
+}
+
+// userAuditFields is the snapshot of an account recorded in audit events. Roles must be preloaded.
+func userAuditFields(user *models.User) map[string]interface{} {
+	roles := make([]string, 0, len(user.Roles))
+	for _, role := range user.Roles {
+		roles = append(roles, role.Name)
+	}
+	sort.Strings(roles)
+	return map[string]interface{}{
+		"email":    user.Email,
+		"roles":    roles,
+		"disabled": user.DisabledAt != nil,
+	}
+}
+
+// parseUserID reads the {id} path value, writing a 400 response when it is invalid.
+func parseUserID(w http.ResponseWriter, r *http.Request) (uint, bool) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil || id <= 0 {
+		utils.JSONError(w, r, http.StatusBadRequest, "Invalid user id", "validation_error", "")
+		return 0, false
+	}
+	return uint(id), true
+}
+
+// deleteUserData removes an account and everything that belongs to it.
+func deleteUserData(tx *gorm.DB, userID uint) error {
+	for _, model := range []interface{}{
+		&models.RefreshToken{},
+		&models.RevokedToken{},
+		&models.OneTimeToken{},
+		&models.MFARecoveryCode{},
+		&models.APIKey{},
+		&models.ExternalIdentity{},
+		&models.Session{},
+	} {
+		if err := tx.Where("user_id = ?", userID).Delete(model).Error; err != nil {
+			return err
+		}
+	}
+	user := models.User{ID: userID}
+	if err := tx.Model(&user).Association("Roles").Clear(); err != nil {
+		return err
+	}
+	return tx.Delete(&user).Error
+}
+
+// ListUsers lists accounts by id (or created_at) with cursor pagination. ?email=
+// filters by a case-insensitive substring of the address.
+func ListUsers(w http.ResponseWriter, r *http.Request) {
+	page, ok := parseKeysetPage(w, r)
+	if !ok {
+		return
+	}
+	var users []models.User
+
+	q := config.DB.Model(&models.User{}).Preload("Roles")
+	if email := strings.TrimSpace(strings.ToLower(r.URL.Query().Get("email"))); email != "" {
+		escaped := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(email)
+		q = q.Where("email LIKE ?", "%"+escaped+"%")
+	}
+	if err := page.apply(q, "users").Find(&users).Error; err != nil {
+		utils.JSONError(w, r, http.StatusInternalServerError, "Failed to get users", "db_query_failed", err.Error())
+		return
+	}
+	users, nextCursor, prevCursor := pageCursors(page, users, func(u *models.User) (time.Time, uint) {
+		return u.CreatedAt, u.ID
+	})
+
+	items := make([]UserResponse, len(users))
+	for i := range users {
+		items[i] = newUserResponse(&users[i])
+	}
+
+	utils.JSONSuccess(w, r, "Successfully retrieved the users", map[string]interface{}{
+		"items":       items,
+		"next_cursor": nextCursor,
+		"prev_cursor": prevCursor,
+	})
+}
+
+func GetUser(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseUserID(w, r)
+	if !ok {
+		return
+	}
+	var user models.User
+	if err := config.DB.Preload("Roles").First(&user, id).Error; err != nil {
+		utils.JSONError(w, r, http.StatusNotFound, "User not found", "not_found", "")
+		return
+	}
+	utils.JSONSuccess(w, r, "Successfully retrieved the user", newUserResponse(&user))
+}
+
+// UpdateUser changes a user's roles, admin status or disabled flag. Disabling a
+// user revokes all of their sessions and API keys. Admins can't disable or demote themselves.
+func UpdateUser(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseUserID(w, r)
+	if !ok {
+		return
+	}
+	actor, _ := middlewares.GetAuthenticatedUser(r)
+
+	var input UpdateUserInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		utils.JSONError(w, r, http.StatusBadRequest, "Invalid request body", "invalid_request", err.Error())
+		return
+	}
+
+	var user models.User
+	if err := config.DB.Preload("Roles").First(&user, id).Error; err != nil {
+		utils.JSONError(w, r, http.StatusNotFound, "User not found", "not_found", "")
+		return
+	}
+
+	// resolve the target role set
+	roleNames := map[string]bool{}
+	for _, role := range user.Roles {
+		roleNames[role.Name] = true
+	}
+	if input.Roles != nil {
+		roleNames = map[string]bool{}
+		for _, name := range *input.Roles {
+			roleNames[name] = true
+		}
+	}
+	if input.IsAdmin != nil {
+		roleNames[models.RoleSuperadmin] = *input.IsAdmin
+	}
+	names := make([]string, 0, len(roleNames))
+	for name, keep := range roleNames {
+		if keep {
+			names = append(names, name)
+		}
+	}
+
+	if actor != nil && actor.ID == user.ID {
+		if input.Disabled != nil && *input.Disabled {
+			utils.JSONError(w, r, http.StatusBadRequest, "You can't disable your own account", "validation_error", "")
+			return
+		}
+		if actor.IsAdmin() && !roleNames[models.RoleSuperadmin] {
+			utils.JSONError(w, r, http.StatusBadRequest, "You can't remove your own admin status", "validation_error", "")
+			return
+		}
+	}
+
+	var roles []models.Role
+	if len(names) > 0 {
+		if err := config.DB.Where("name IN ?", names).Find(&roles).Error; err != nil {
+			utils.JSONError(w, r, http.StatusInternalServerError, "Failed to load roles", "db_query_failed", err.Error())
+			return
+		}
+	}
+	if len(roles) != len(names) {
+		utils.JSONError(w, r, http.StatusBadRequest, "Unknown role", "validation_error", "roles must be existing role names")
+		return
+	}
+
+	var updated models.User
+	err := config.DB.Transaction(func(tx *gorm.DB) error {
+		if input.Roles != nil || input.IsAdmin != nil {
+			roleAssoc := tx.Model(&user).Association("Roles")
+			if len(roles) == 0 {
+				if err := roleAssoc.Clear(); err != nil {
+					return err
+				}
+			} else if err := roleAssoc.Replace(roles); err != nil {
+				return err
+			}
+		}
+		if input.Disabled != nil && *input.Disabled != (user.DisabledAt != nil) {
+			var disabledAt *time.Time
+			if *input.Disabled {
+				now := time.Now()
+				disabledAt = &now
+			}
+			if err := tx.Model(&user).Omit(clause.Associations).Update("disabled_at", disabledAt).Error; err != nil {
+				return err
+			}
+			if *input.Disabled {
+				if err := revokeUserSessions(tx, user.ID); err != nil {
+					return err
+				}
+				if err := revokeUserAPIKeys(tx, user.ID); err != nil {
+					return err
+				}
+			}
+		}
+		if err := tx.Preload("Roles").First(&updated, user.ID).Error; err != nil {
+			return err
+		}
+		return recordAudit(tx, w, r, auditRecord{Action: "user.update", ResourceType: "user", ResourceID: user.ID, Before: userAuditFields(&user), After: userAuditFields(&updated)})
+	})
+	if err != nil {
+		utils.JSONError(w, r, http.StatusInternalServerError, "Failed to update user", "db_update_failed", err.Error())
+		return
+	}
+
+	utils.JSONSuccess(w, r, "User updated successfully", newUserResponse(&updated))
+}
+
+// DeleteUser permanently removes an account and its tokens.
+func DeleteUser(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseUserID(w, r)
+	if !ok {
+		return
+	}
+	if actor, _ := middlewares.GetAuthenticatedUser(r); actor != nil && actor.ID == id {
+		utils.JSONError(w, r, http.StatusBadRequest, "You can't delete your own account", "validation_error", "")
+		return
+	}
+
+	var user models.User
+	if err := config.DB.Preload("Roles").First(&user, id).Error; err != nil {
+		utils.JSONError(w, r, http.StatusNotFound, "User not found", "not_found", "")
+		return
+	}
+
+	if err := config.DB.Transaction(func(tx *gorm.DB) error {
+		if err := recordAudit(tx, w, r, auditRecord{Action: "user.delete", ResourceType: "user", ResourceID: user.ID, Before: userAuditFields(&user)}); err != nil {
+			return err
+		}
+		return deleteUserData(tx, user.ID)
+	}); err != nil {
+		utils.JSONError(w, r, http.StatusInternalServerError, "Failed to delete user", "db_delete_failed", err.Error())
+		return
+	}
+
+	utils.JSONSuccess(w, r, "User deleted successfully", nil)
+}
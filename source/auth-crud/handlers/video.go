@@ -7,42 +7,56 @@ import (
 	"encoding/json"
 	"net/http"
 	"strconv"
+	"time"
+
+	"gorm.io/gorm"
 )
 
+// GetVideos lists videos with keyset pagination and the filters described at
+// parseVideoFilters. With ?facets=category the response also counts the
+// matching videos per category.
 func GetVideos(w http.ResponseWriter, r *http.Request) {
-	limit, cursor, sortBy, order := utils.ParsePagination(r)
+	page, ok := parseKeysetPage(w, r)
+	if !ok {
+		return
+	}
 	var videos []models.Video
 
-	q := config.DB.Model(&models.Video{}).Preload("Category")
-	if cursor != "" {
-		if id, err := strconv.Atoi(cursor); err == nil {
-			if order == "asc" {
-				q = q.Where("id > ?", id)
-			} else {
-				q = q.Where("id < ?", id)
-			}
-		}
-	}
-	if sortBy == "created_at" {
-		q = q.Order("created_at " + order)
-	} else {
-		q = q.Order("id " + order)
+	filter, err := parseVideoFilters(r)
+	if err != nil {
+		utils.JSONError(w, r, http.StatusBadRequest, "Invalid filter", "validation_error", err.Error())
+		return
 	}
-	if err := q.Limit(limit).Find(&videos).Error; err != nil {
-		utils.JSONError(w, r, http.StatusInternalServerError, "Failed to get videos", "db_query_failed", err.Error())
+	facets := r.URL.Query().Get("facets")
+	if facets != "" && facets != "category" {
+		utils.JSONError(w, r, http.StatusBadRequest, "Invalid facets", "validation_error", "supported facets: category")
 		return
 	}
 
-	nextCursor := ""
-	if len(videos) > 0 {
-		last := videos[len(videos)-1]
-		nextCursor = utils.BuildNextCursor(len(videos), limit, last.ID)
+	q := filter.apply(config.DB.Model(&models.Video{}).Preload("Category"), true)
+	if err := page.apply(q, "videos").Find(&videos).Error; err != nil {
+		utils.JSONError(w, r, http.StatusInternalServerError, "Failed to get videos", "db_query_failed", err.Error())
+		return
 	}
+	videos, nextCursor, prevCursor := pageCursors(page, videos, func(v *models.Video) (time.Time, uint) {
+		return v.CreatedAt, v.ID
+	})
 
-	utils.JSONSuccess(w, r, "Successfully retrieved the videos", map[string]interface{}{
+	data := map[string]interface{}{
 		"items":       videos,
 		"next_cursor": nextCursor,
-	})
+		"prev_cursor": prevCursor,
+	}
+	if facets == "category" {
+		counts, err := categoryFacets(config.DB, filter)
+		if err != nil {
+			utils.JSONError(w, r, http.StatusInternalServerError, "Failed to get videos", "db_query_failed", err.Error())
+			return
+		}
+		data["facets"] = map[string]interface{}{"category": counts}
+	}
+
+	utils.JSONSuccess(w, r, "Successfully retrieved the videos", data)
 }
 
 func GetVideo(w http.ResponseWriter, r *http.Request) {
@@ -66,7 +80,8 @@ func GetVideo(w http.ResponseWriter, r *http.Request) {
 }
 
 // VideoInput represents the payload for creating/updating a video.
-// Only fields that clients are allowed to set are included here.
+// Only fields that clients are allowed to set are included here. Duration
+// takes any format read by models.ParseVideoDuration.
 type VideoInput struct {
 	Title         string `json:"title"`
 	Duration      string `json:"duration"`
@@ -75,6 +90,23 @@ type VideoInput struct {
 	CategoryID    uint   `json:"categoryId"`
 }
 
+// videoAuditFields is the snapshot of a video recorded in audit events.
+func videoAuditFields(v *models.Video) map[string]interface{} {
+	return map[string]interface{}{
+		"title":            v.Title,
+		"duration_seconds": v.DurationSeconds,
+		"url":              v.URL,
+		"thumbnail_path":   v.ThumbnailPath,
+		"category_id":      v.CategoryID,
+	}
+}
+
+// indexVideoForSearch recomputes the full-text search vector of a video. Call
+// it in the transaction writing the video.
+func indexVideoForSearch(tx *gorm.DB, id uint) error {
+	return tx.Exec("UPDATE videos SET search_vector = "+models.VideoSearchVectorSQL+" WHERE id = ?", id).Error
+}
+
 func CreateVideo(w http.ResponseWriter, r *http.Request) {
 	var input VideoInput
 	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
@@ -86,6 +118,11 @@ func CreateVideo(w http.ResponseWriter, r *http.Request) {
 		utils.JSONError(w, r, http.StatusBadRequest, "Missing required fields", "validation_error", "")
 		return
 	}
+	durationSeconds, err := models.ParseVideoDuration(input.Duration)
+	if err != nil {
+		utils.JSONError(w, r, http.StatusBadRequest, "Invalid duration", "validation_error", err.Error())
+		return
+	}
 
 	// Ensure category exists
 	var category models.Category
@@ -95,14 +132,22 @@ func CreateVideo(w http.ResponseWriter, r *http.Request) {
 	}
 
 	video := models.Video{
-		Title:         input.Title,
-		Duration:      input.Duration,
-		URL:           input.URL,
-		ThumbnailPath: input.ThumbnailPath,
-		CategoryID:    input.CategoryID,
+		Title:           input.Title,
+		DurationSeconds: &durationSeconds,
+		URL:             input.URL,
+		ThumbnailPath:   input.ThumbnailPath,
+		CategoryID:      input.CategoryID,
 	}
 
-	if err := config.DB.Create(&video).Error; err != nil {
+	if err := config.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&video).Error; err != nil {
+			return err
+		}
+		if err := indexVideoForSearch(tx, video.ID); err != nil {
+			return err
+		}
+		return recordAudit(tx, w, r, auditRecord{Action: "video.create", ResourceType: "video", ResourceID: video.ID, After: videoAuditFields(&video)})
+	}); err != nil {
 		utils.JSONError(w, r, http.StatusInternalServerError, "Failed to create video", "db_create_failed", err.Error())
 		return
 	}
@@ -132,6 +177,7 @@ func UpdateVideo(w http.ResponseWriter, r *http.Request) {
 		utils.JSONError(w, r, http.StatusBadRequest, "Invalid request body", "invalid_request", err.Error())
 		return
 	}
+	before := videoAuditFields(&existing)
 
 	// If categoryId is provided, validate it
 	if input.CategoryID != 0 {
@@ -147,7 +193,12 @@ func UpdateVideo(w http.ResponseWriter, r *http.Request) {
 		existing.Title = input.Title
 	}
 	if input.Duration != "" {
-		existing.Duration = input.Duration
+		durationSeconds, err := models.ParseVideoDuration(input.Duration)
+		if err != nil {
+			utils.JSONError(w, r, http.StatusBadRequest, "Invalid duration", "validation_error", err.Error())
+			return
+		}
+		existing.DurationSeconds = &durationSeconds
 	}
 	if input.URL != "" {
 		existing.URL = input.URL
@@ -156,7 +207,15 @@ func UpdateVideo(w http.ResponseWriter, r *http.Request) {
 		existing.ThumbnailPath = input.ThumbnailPath
 	}
 
-	if err := config.DB.Save(&existing).Error; err != nil {
+	if err := config.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(&existing).Error; err != nil {
+			return err
+		}
+		if err := indexVideoForSearch(tx, existing.ID); err != nil {
+			return err
+		}
+		return recordAudit(tx, w, r, auditRecord{Action: "video.update", ResourceType: "video", ResourceID: existing.ID, Before: before, After: videoAuditFields(&existing)})
+	}); err != nil {
 		utils.JSONError(w, r, http.StatusInternalServerError, "Failed to update video", "db_update_failed", err.Error())
 		return
 	}
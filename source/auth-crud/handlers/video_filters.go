@@ -0,0 +1,127 @@
+package handlers
+
+import (
+	"auth-crud/models"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// videoFilter holds the query filters of GetVideos.
+type videoFilter struct {
+	CategoryIDs        []int
+	IncludeDescendants bool
+	Title              string
+	CreatedAfter       *time.Time
+	CreatedBefore      *time.Time
+	MinDuration        *int64
+	MaxDuration        *int64
+}
+
+// parseVideoFilters reads the filters of GetVideos from the query string:
+// category_id (repeatable or comma-separated), include_descendants, title,
+// created_after / created_before (RFC 3339) and min_duration / max_duration
+// (seconds or a duration such as "10m" or "PT10M").
+func parseVideoFilters(r *http.Request) (*videoFilter, error) {
+	query := r.URL.Query()
+	f := &videoFilter{Title: strings.TrimSpace(query.Get("title"))}
+
+	for _, v := range query["category_id"] {
+		for _, part := range strings.Split(v, ",") {
+			id, err := strconv.Atoi(strings.TrimSpace(part))
+			if err != nil || id <= 0 {
+				return nil, errors.New("category_id: must be positive integers")
+			}
+			f.CategoryIDs = append(f.CategoryIDs, id)
+		}
+	}
+	f.IncludeDescendants, _ = strconv.ParseBool(query.Get("include_descendants"))
+
+	for param, dst := range map[string]**time.Time{"created_after": &f.CreatedAfter, "created_before": &f.CreatedBefore} {
+		if v := query.Get(param); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return nil, errors.New(param + ": must be an RFC 3339 time")
+			}
+			*dst = &t
+		}
+	}
+	for param, dst := range map[string]**int64{"min_duration": &f.MinDuration, "max_duration": &f.MaxDuration} {
+		if v := query.Get(param); v != "" {
+			seconds, err := parseDurationParam(v)
+			if err != nil {
+				return nil, errors.New(param + ": must be seconds or a duration such as 10m or PT10M")
+			}
+			*dst = &seconds
+		}
+	}
+	return f, nil
+}
+
+// parseDurationParam reads whole seconds ("90") or any video duration format
+// ("1m30s", "PT1M30S", "00:01:30").
+func parseDurationParam(v string) (int64, error) {
+	if n, err := strconv.ParseInt(v, 10, 64); err == nil && n >= 0 {
+		return n, nil
+	}
+	return models.ParseVideoDuration(v)
+}
+
+// apply adds the filters to q. The category filter is left out when
+// withCategory is false, which is how category facets are counted.
+func (f *videoFilter) apply(q *gorm.DB, withCategory bool) *gorm.DB {
+	if withCategory && len(f.CategoryIDs) > 0 {
+		if f.IncludeDescendants {
+			q = q.Where(`videos.category_id IN (WITH RECURSIVE tree AS (
+					SELECT id FROM categories WHERE id IN ?
+					UNION
+					SELECT c.id FROM categories c JOIN tree t ON c.parent_id = t.id
+				) SELECT id FROM tree)`, f.CategoryIDs)
+		} else {
+			q = q.Where("videos.category_id IN ?", f.CategoryIDs)
+		}
+	}
+	if f.Title != "" {
+		escaped := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(f.Title)
+		q = q.Where("videos.title ILIKE ?", "%"+escaped+"%")
+	}
+	if f.CreatedAfter != nil {
+		q = q.Where("videos.created_at >= ?", *f.CreatedAfter)
+	}
+	if f.CreatedBefore != nil {
+		q = q.Where("videos.created_at < ?", *f.CreatedBefore)
+	}
+	if f.MinDuration != nil {
+		q = q.Where("videos.duration_seconds >= ?", *f.MinDuration)
+	}
+	if f.MaxDuration != nil {
+		q = q.Where("videos.duration_seconds <= ?", *f.MaxDuration)
+	}
+	return q
+}
+
+// CategoryFacet is the number of matching videos in one category.
+type CategoryFacet struct {
+	CategoryID uint   `json:"category_id"`
+	Name       string `json:"name"`
+	Count      int64  `json:"count"`
+}
+
+// categoryFacets counts the videos matching every filter but the category
+// filter, per category, so clients can offer the other categories as choices.
+func categoryFacets(db *gorm.DB, f *videoFilter) ([]CategoryFacet, error) {
+	facets := []CategoryFacet{}
+	q := db.Table("videos").
+		Select("videos.category_id, categories.name, COUNT(*) AS count").
+		Joins("JOIN categories ON categories.id = videos.category_id").
+		Where("videos.deleted_at IS NULL")
+	err := f.apply(q, false).
+		Group("videos.category_id, categories.name").
+		Order("count DESC, categories.name ASC").
+		Scan(&facets).Error
+	return facets, err
+}
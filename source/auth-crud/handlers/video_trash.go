@@ -0,0 +1,136 @@
+package handlers
+
+import (
+	"auth-crud/config"
+	"auth-crud/loggers"
+	"auth-crud/models"
+	"auth-crud/utils"
+	"net/http"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Environment variables:
+// VIDEO_TRASH_RETENTION: how long deleted videos can be restored before they are purged (default 720h)
+// VIDEO_PURGE_INTERVAL: how often the purge job runs (default 1h)
+
+// parseVideoID reads the {id} path value, writing a 400 response when it is invalid.
+func parseVideoID(w http.ResponseWriter, r *http.Request) (uint, bool) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil || id <= 0 {
+		utils.JSONError(w, r, http.StatusBadRequest, "Invalid video id", "validation_error", "")
+		return 0, false
+	}
+	return uint(id), true
+}
+
+// DeleteVideo moves a video to the trash. It disappears from the public
+// endpoints and can be restored until the purge job removes it.
+func DeleteVideo(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseVideoID(w, r)
+	if !ok {
+		return
+	}
+	var video models.Video
+	if err := config.DB.First(&video, id).Error; err != nil {
+		utils.JSONError(w, r, http.StatusNotFound, "Video not found", "not_found", "")
+		return
+	}
+
+	if err := config.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(&video).Error; err != nil {
+			return err
+		}
+		return recordAudit(tx, w, r, auditRecord{Action: "video.delete", ResourceType: "video", ResourceID: video.ID, Before: videoAuditFields(&video)})
+	}); err != nil {
+		utils.JSONError(w, r, http.StatusInternalServerError, "Failed to delete video", "db_delete_failed", err.Error())
+		return
+	}
+	utils.JSONSuccess(w, r, "Video moved to trash", nil)
+}
+
+// RestoreVideo takes a video out of the trash.
+func RestoreVideo(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseVideoID(w, r)
+	if !ok {
+		return
+	}
+	var video models.Video
+	if err := config.DB.Unscoped().Where("id = ? AND deleted_at IS NOT NULL", id).First(&video).Error; err != nil {
+		utils.JSONError(w, r, http.StatusNotFound, "Video not found in trash", "not_found", "")
+		return
+	}
+
+	if err := config.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Model(&models.Video{}).Where("id = ?", video.ID).Update("deleted_at", nil).Error; err != nil {
+			return err
+		}
+		return recordAudit(tx, w, r, auditRecord{Action: "video.restore", ResourceType: "video", ResourceID: video.ID, After: videoAuditFields(&video)})
+	}); err != nil {
+		utils.JSONError(w, r, http.StatusInternalServerError, "Failed to restore video", "db_update_failed", err.Error())
+		return
+	}
+
+	var restored models.Video
+	config.DB.Preload("Category").First(&restored, video.ID)
+	utils.JSONSuccess(w, r, "Video restored successfully", restored)
+}
+
+// ListTrashedVideos lists deleted videos by descending id with cursor pagination.
+// Each is purged once its DeletedAt is older than the reported retention.
+func ListTrashedVideos(w http.ResponseWriter, r *http.Request) {
+	page, ok := parseKeysetPage(w, r)
+	if !ok {
+		return
+	}
+	page.SortBy, page.Order = "id", "desc"
+	var videos []models.Video
+
+	q := config.DB.Unscoped().Model(&models.Video{}).Preload("Category").Where("videos.deleted_at IS NOT NULL")
+	if err := page.apply(q, "videos").Find(&videos).Error; err != nil {
+		utils.JSONError(w, r, http.StatusInternalServerError, "Failed to get trashed videos", "db_query_failed", err.Error())
+		return
+	}
+	videos, nextCursor, prevCursor := pageCursors(page, videos, func(v *models.Video) (time.Time, uint) {
+		return v.CreatedAt, v.ID
+	})
+
+	utils.JSONSuccess(w, r, "Successfully retrieved the trashed videos", map[string]interface{}{
+		"items":       videos,
+		"next_cursor": nextCursor,
+		"prev_cursor": prevCursor,
+		"retention":   videoTrashRetention().String(),
+	})
+}
+
+func videoTrashRetention() time.Duration {
+	return utils.DurationFromEnv("VIDEO_TRASH_RETENTION", 30*24*time.Hour)
+}
+
+// PurgeTrashedVideos permanently deletes videos that have been in the trash
+// longer than the retention period and returns how many were removed.
+func PurgeTrashedVideos() (int64, error) {
+	res := config.DB.Unscoped().
+		Where("deleted_at IS NOT NULL AND deleted_at < ?", time.Now().Add(-videoTrashRetention())).
+		Delete(&models.Video{})
+	return res.RowsAffected, res.Error
+}
+
+// StartVideoPurger runs PurgeTrashedVideos now and then every VIDEO_PURGE_INTERVAL
+// in the background.
+func StartVideoPurger() {
+	interval := utils.DurationFromEnv("VIDEO_PURGE_INTERVAL", time.Hour)
+	go func() {
+		for {
+			n, err := PurgeTrashedVideos()
+			if err != nil {
+				loggers.Error("Failed to purge trashed videos: ", err)
+			} else if n > 0 {
+				loggers.Info("Purged ", n, " trashed video(s)")
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
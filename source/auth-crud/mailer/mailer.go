@@ -0,0 +1,186 @@
+package mailer
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"auth-crud/loggers"
+)
+
+// Environment variables:
+// MAILER: "smtp" or "log" (required). Mails carry password-reset, verification and
+//   login links, so MAILER=log also needs MAILER_LOG_ALLOWED=true and is meant for
+//   local development only.
+// MAILER_LOG_ALLOWED: set to true to accept MAILER=log
+// MAIL_FROM: sender address (default: no-reply@localhost)
+// MAIL_LOG_PATH: when MAILER=log, append whole messages to this file; without it only
+//   the recipient and subject are logged
+// SMTP_HOST (required), SMTP_PORT (default 587), SMTP_USERNAME, SMTP_PASSWORD: when MAILER=smtp
+
+// Message is a plain-text email.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers outgoing email.
+type Mailer interface {
+	Send(msg Message) error
+}
+
+var (
+	current Mailer
+	mu      sync.Mutex
+)
+
+func fromEnv() (Mailer, error) {
+	from := os.Getenv("MAIL_FROM")
+	if from == "" {
+		from = "no-reply@localhost"
+	}
+	switch os.Getenv("MAILER") {
+	case "smtp":
+		if os.Getenv("SMTP_HOST") == "" {
+			return nil, errors.New("SMTP_HOST is required with MAILER=smtp")
+		}
+		port := os.Getenv("SMTP_PORT")
+		if port == "" {
+			port = "587"
+		}
+		return &SMTPMailer{
+			Host:     os.Getenv("SMTP_HOST"),
+			Port:     port,
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			From:     from,
+		}, nil
+	case "log":
+		if allowed, _ := strconv.ParseBool(os.Getenv("MAILER_LOG_ALLOWED")); !allowed {
+			return nil, errors.New("MAILER=log writes account links where they can be read; set MAILER_LOG_ALLOWED=true for local development")
+		}
+		return &LogMailer{Path: os.Getenv("MAIL_LOG_PATH"), From: from}, nil
+	case "":
+		return nil, errors.New(`MAILER must be set to "smtp" (or "log" for local development)`)
+	default:
+		return nil, fmt.Errorf("MAILER: unknown mailer %q", os.Getenv("MAILER"))
+	}
+}
+
+// Load configures the default mailer from the environment, failing when no
+// transport is configured. Call it at startup.
+func Load() error {
+	m, err := fromEnv()
+	if err != nil {
+		return err
+	}
+	SetDefault(m)
+	return nil
+}
+
+// unconfigured fails every send with the configuration error.
+type unconfigured struct{ err error }
+
+func (m unconfigured) Send(Message) error { return m.err }
+
+// Default returns the mailer configured through the environment.
+func Default() Mailer {
+	mu.Lock()
+	defer mu.Unlock()
+	if current == nil {
+		m, err := fromEnv()
+		if err != nil {
+			return unconfigured{err}
+		}
+		current = m
+	}
+	return current
+}
+
+// SetDefault replaces the mailer used by Send, e.g. to plug in another provider.
+func SetDefault(m Mailer) {
+	mu.Lock()
+	current = m
+	mu.Unlock()
+}
+
+// Send delivers msg through the default mailer.
+func Send(msg Message) error {
+	return Default().Send(msg)
+}
+
+// SMTPMailer sends mail through an SMTP relay, upgrading to TLS when the server offers STARTTLS.
+type SMTPMailer struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+}
+
+func (m *SMTPMailer) Send(msg Message) error {
+	if m.Host == "" {
+		return fmt.Errorf("SMTP_HOST is not configured")
+	}
+	var auth smtp.Auth
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+	return smtp.SendMail(net.JoinHostPort(m.Host, m.Port), auth, m.From, []string{msg.To}, render(m.From, msg))
+}
+
+// LogMailer writes messages to a file instead of sending them. Without a file
+// only the recipient and subject go to the JSON log: bodies carry account links.
+// It is meant for local development.
+type LogMailer struct {
+	Path string
+	From string
+	mu   sync.Mutex
+}
+
+func (m *LogMailer) Send(msg Message) error {
+	if m.Path == "" {
+		loggers.Log(map[string]interface{}{
+			"level":   "info",
+			"msg":     "mail (not sent, MAILER=log)",
+			"to":      msg.To,
+			"subject": msg.Subject,
+		})
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_ = os.MkdirAll(filepath.Dir(m.Path), 0o755)
+	f, err := os.OpenFile(m.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(render(m.From, msg), "\r\n"...))
+	return err
+}
+
+// headerValue strips line breaks so values can't inject extra headers.
+var headerValue = strings.NewReplacer("\r", "", "\n", "")
+
+func render(from string, msg Message) []byte {
+	var b strings.Builder
+	b.WriteString("From: " + headerValue.Replace(from) + "\r\n")
+	b.WriteString("To: " + headerValue.Replace(msg.To) + "\r\n")
+	b.WriteString("Subject: " + headerValue.Replace(msg.Subject) + "\r\n")
+	b.WriteString("Date: " + time.Now().UTC().Format(time.RFC1123Z) + "\r\n")
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	return []byte(b.String())
+}
@@ -0,0 +1,30 @@
+package mailer
+
+import "testing"
+
+func TestFromEnv(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		wantErr bool
+	}{
+		{name: "unset", wantErr: true},
+		{name: "unknown", env: map[string]string{"MAILER": "sendgrid"}, wantErr: true},
+		{name: "smtp without host", env: map[string]string{"MAILER": "smtp"}, wantErr: true},
+		{name: "smtp", env: map[string]string{"MAILER": "smtp", "SMTP_HOST": "smtp.example.com"}},
+		{name: "log without the flag", env: map[string]string{"MAILER": "log"}, wantErr: true},
+		{name: "log refused", env: map[string]string{"MAILER": "log", "MAILER_LOG_ALLOWED": "false"}, wantErr: true},
+		{name: "log allowed", env: map[string]string{"MAILER": "log", "MAILER_LOG_ALLOWED": "true"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, key := range []string{"MAILER", "MAILER_LOG_ALLOWED", "SMTP_HOST"} {
+				t.Setenv(key, tt.env[key])
+			}
+			m, err := fromEnv()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("fromEnv() = %v, %v, want error %v", m, err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -6,7 +6,11 @@ import (
 	"auth-crud/config"
 	"auth-crud/handlers"
 	"auth-crud/loggers"
+	"auth-crud/mailer"
 	"auth-crud/middlewares"
+	"auth-crud/models"
+	"auth-crud/sso"
+	"auth-crud/utils"
 
 	"github.com/joho/godotenv"
 )
@@ -19,25 +23,104 @@ func main() {
 		loggers.Info(".env not found, relying on environment variables")
 	}
 
+	if err := utils.LoadSigningKeys(); err != nil {
+		loggers.Error("Failed to load JWT signing keys:", err)
+		return
+	}
+
+	if err := utils.CheckTokenSigningSecret(); err != nil {
+		loggers.Error("Failed to configure token signing:", err)
+		return
+	}
+
+	if err := utils.LoadPasswordHasher(); err != nil {
+		loggers.Error("Failed to configure password hashing:", err)
+		return
+	}
+
+	if err := utils.LoadPasswordPolicy(); err != nil {
+		loggers.Error("Failed to load password policy:", err)
+		return
+	}
+
+	if err := mailer.Load(); err != nil {
+		loggers.Error("Failed to configure the mailer:", err)
+		return
+	}
+
+	if err := sso.LoadProviders(); err != nil {
+		loggers.Error("Failed to load OIDC providers:", err)
+		return
+	}
+
 	if err := config.ConnectDB(); err != nil {
 		loggers.Error("Failed to connect to database:", err)
 		return
 	}
 
+	handlers.StartVideoPurger()
+
 	mux := http.NewServeMux()
 	mux.HandleFunc("/api/v1/auth/register", handlers.Register)
 	mux.HandleFunc("/api/v1/auth/login", handlers.Login)
+	mux.HandleFunc("/api/v1/auth/refresh", handlers.Refresh)
+	mux.HandleFunc("/api/v1/auth/logout", middlewares.RequireSession(handlers.Logout))
+	mux.HandleFunc("/api/v1/auth/logout-all", middlewares.RequireSession(middlewares.BlockImpersonation(handlers.LogoutAll)))
+	mux.HandleFunc("/api/v1/auth/verify-email", handlers.VerifyEmail)
+	mux.HandleFunc("/api/v1/auth/verify-email/resend", handlers.ResendVerification)
+	mux.HandleFunc("/api/v1/auth/forgot-password", handlers.ForgotPassword)
+	mux.HandleFunc("/api/v1/auth/reset-password", handlers.ResetPassword)
+	mux.HandleFunc("/api/v1/auth/mfa/verify", handlers.VerifyMFA)
+	mux.HandleFunc("/api/v1/auth/mfa/totp/enroll", middlewares.RequireSession(middlewares.BlockImpersonation(handlers.EnrollTOTP)))
+	mux.HandleFunc("/api/v1/auth/mfa/totp/confirm", middlewares.RequireSession(middlewares.BlockImpersonation(handlers.ConfirmTOTP)))
+	mux.HandleFunc("/api/v1/auth/mfa/totp/disable", middlewares.RequireSession(middlewares.BlockImpersonation(handlers.DisableTOTP)))
+	mux.HandleFunc("/api/v1/auth/confirm-email-change", handlers.ConfirmEmailChange)
+	mux.HandleFunc("POST /api/v1/auth/magic-link", handlers.RequestMagicLink)
+	mux.HandleFunc("POST /api/v1/auth/magic-link/consume", handlers.ConsumeMagicLink)
+	mux.HandleFunc("GET /api/v1/auth/oidc/{provider}/start", handlers.OIDCStart)
+	mux.HandleFunc("GET /api/v1/auth/oidc/{provider}/callback", handlers.OIDCCallback)
+	mux.HandleFunc("/.well-known/jwks.json", handlers.JWKS)
+
+	// Account
+	mux.HandleFunc("GET /api/v1/me", middlewares.RequireAuth(handlers.GetMe))
+	mux.HandleFunc("DELETE /api/v1/me", middlewares.RequireSession(middlewares.BlockImpersonation(handlers.DeleteMe)))
+	mux.HandleFunc("POST /api/v1/me/password", middlewares.RequireSession(middlewares.BlockImpersonation(handlers.ChangePassword)))
+	mux.HandleFunc("POST /api/v1/me/email", middlewares.RequireSession(middlewares.BlockImpersonation(handlers.ChangeEmail)))
+	mux.HandleFunc("GET /api/v1/me/sessions", middlewares.RequireSession(handlers.ListSessions))
+	mux.HandleFunc("DELETE /api/v1/me/sessions/{id}", middlewares.RequireSession(middlewares.BlockImpersonation(handlers.RevokeSession)))
+	mux.HandleFunc("GET /api/v1/me/api-keys", middlewares.RequireSession(handlers.ListAPIKeys))
+	mux.HandleFunc("POST /api/v1/me/api-keys", middlewares.RequireSession(middlewares.BlockImpersonation(handlers.CreateAPIKey)))
+	mux.HandleFunc("DELETE /api/v1/me/api-keys/{id}", middlewares.RequireSession(middlewares.BlockImpersonation(handlers.RevokeAPIKey)))
+
 	mux.HandleFunc("/api/v1/videos", handlers.GetVideos)
 	mux.HandleFunc("/api/v1/videos/{id}", handlers.GetVideo)
-	mux.HandleFunc("/api/admin/v1/videos", middlewares.RequireAdmin(handlers.CreateVideo))
-	mux.HandleFunc("/api/admin/v1/videos/{id}", middlewares.RequireAdmin(handlers.UpdateVideo))
+	mux.HandleFunc("GET /api/v1/search", handlers.SearchVideos)
+	mux.HandleFunc("/api/admin/v1/videos", middlewares.RequirePermission(models.PermissionVideosWrite)(handlers.CreateVideo))
+	mux.HandleFunc("/api/admin/v1/videos/{id}", middlewares.RequirePermission(models.PermissionVideosWrite)(handlers.UpdateVideo))
+	mux.HandleFunc("DELETE /api/admin/v1/videos/{id}", middlewares.RequirePermission(models.PermissionVideosWrite)(handlers.DeleteVideo))
+	mux.HandleFunc("POST /api/admin/v1/videos/{id}/restore", middlewares.RequirePermission(models.PermissionVideosWrite)(handlers.RestoreVideo))
+	mux.HandleFunc("GET /api/admin/v1/videos/trash", middlewares.RequirePermission(models.PermissionVideosWrite)(handlers.ListTrashedVideos))
 
 	mux.HandleFunc("/api/v1/categories", handlers.GetCategories)
 	mux.HandleFunc("/api/v1/categories/{id}", handlers.GetCategory)
-	mux.HandleFunc("/api/admin/v1/categories", middlewares.RequireAdmin(handlers.CreateCategory))
+	mux.HandleFunc("GET /api/v1/categories/tree", handlers.GetCategoryTree)
+	mux.HandleFunc("/api/admin/v1/categories", middlewares.RequirePermission(models.PermissionCategoriesWrite)(handlers.CreateCategory))
+	mux.HandleFunc("PATCH /api/admin/v1/categories/{id}", middlewares.RequirePermission(models.PermissionCategoriesWrite)(handlers.UpdateCategory))
+	mux.HandleFunc("DELETE /api/admin/v1/categories/{id}", middlewares.RequirePermission(models.PermissionCategoriesWrite)(handlers.DeleteCategory))
+
+	// Users
+	mux.HandleFunc("GET /api/admin/v1/users", middlewares.RequirePermission(models.PermissionUsersManage)(handlers.ListUsers))
+	mux.HandleFunc("GET /api/admin/v1/users/{id}", middlewares.RequirePermission(models.PermissionUsersManage)(handlers.GetUser))
+	mux.HandleFunc("PATCH /api/admin/v1/users/{id}", middlewares.RequirePermission(models.PermissionUsersManage)(middlewares.BlockImpersonation(handlers.UpdateUser)))
+	mux.HandleFunc("DELETE /api/admin/v1/users/{id}", middlewares.RequirePermission(models.PermissionUsersManage)(middlewares.BlockImpersonation(handlers.DeleteUser)))
+	mux.HandleFunc("GET /api/admin/v1/users/{id}/sessions", middlewares.RequirePermission(models.PermissionUsersManage)(handlers.ListUserSessions))
+	mux.HandleFunc("POST /api/admin/v1/users/{id}/impersonate", middlewares.RequirePermission(models.PermissionUsersImpersonate)(middlewares.BlockImpersonation(handlers.ImpersonateUser)))
+
+	// Audit
+	mux.HandleFunc("GET /api/admin/v1/audit-events", middlewares.RequirePermission(models.PermissionAuditRead)(handlers.ListAuditEvents))
 
 	// Uploads
-	mux.HandleFunc("/api/admin/v1/uploads", middlewares.RequireAdmin(handlers.UploadFile))
+	mux.HandleFunc("/api/admin/v1/uploads", middlewares.RequirePermission(models.PermissionUploadsCreate)(handlers.UploadFile))
 	mux.Handle("/uploads/", http.StripPrefix("/uploads/", http.FileServer(http.Dir("/uploads"))))
 
 	loggers.Info("HTTP server listening on :8080")
@@ -3,14 +3,18 @@ package middlewares
 import (
 	"auth-crud/config"
 	"auth-crud/models"
+	"auth-crud/utils"
 	"net/http"
-	"os"
-	"strconv"
 	"strings"
+	"time"
 
 	"context"
+)
 
-	"github.com/golang-jwt/jwt/v4"
+// apiKeyTouchInterval and sessionTouchInterval limit how often last-used times are written.
+const (
+	apiKeyTouchInterval  = time.Minute
+	sessionTouchInterval = time.Minute
 )
 
 // contextKey is an unexported type to avoid key collisions in context
@@ -20,6 +24,9 @@ type contextKey string
 const (
 	contextUserIDKey contextKey = "auth.userId"
 	contextUserKey   contextKey = "auth.user"
+	contextClaimsKey contextKey = "auth.claims"
+	contextAPIKeyKey contextKey = "auth.apiKey"
+	contextActorKey  contextKey = "auth.actor"
 )
 
 // GetAuthenticatedUser returns the authenticated user from the request context, if present.
@@ -29,66 +36,217 @@ func GetAuthenticatedUser(r *http.Request) (*models.User, bool) {
 	return user, ok
 }
 
-// RequireAuth validates the Bearer token, loads the user, and injects it into the request context.
+// GetTokenClaims returns the claims of the access token used for the request, if present.
+func GetTokenClaims(r *http.Request) (*utils.TokenClaims, bool) {
+	claims, ok := r.Context().Value(contextClaimsKey).(*utils.TokenClaims)
+	return claims, ok
+}
+
+// GetAPIKey returns the API key used for the request, if it was authenticated with one.
+func GetAPIKey(r *http.Request) (*models.APIKey, bool) {
+	key, ok := r.Context().Value(contextAPIKeyKey).(*models.APIKey)
+	return key, ok
+}
+
+// GetImpersonator returns the admin acting as the authenticated user, if the
+// request was made with an impersonation token.
+func GetImpersonator(r *http.Request) (*models.User, bool) {
+	actor, ok := r.Context().Value(contextActorKey).(*models.User)
+	return actor, ok
+}
+
+// credentials extracts the credential from the request: a Bearer access token,
+// or an API key sent as "Authorization: ApiKey <key>" or in X-API-Key.
+func credentials(r *http.Request) (scheme, value string) {
+	if key := strings.TrimSpace(r.Header.Get("X-API-Key")); key != "" {
+		return "apikey", key
+	}
+	scheme, value, _ = strings.Cut(r.Header.Get("Authorization"), " ")
+	return strings.ToLower(scheme), strings.TrimSpace(value)
+}
+
+// authenticateToken checks an access token and loads the user it was issued for.
+func authenticateToken(w http.ResponseWriter, tokenString string) (*models.User, *utils.TokenClaims, bool) {
+	claims, err := utils.ParseToken(tokenString)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return nil, nil, false
+	}
+
+	var revoked int64
+	if err := config.DB.Model(&models.RevokedToken{}).Where("jti = ?", claims.ID).Count(&revoked).Error; err != nil || revoked > 0 {
+		http.Error(w, "token revoked", http.StatusUnauthorized)
+		return nil, nil, false
+	}
+
+	var user models.User
+	if err := config.DB.Preload("Roles.Permissions").First(&user, claims.UserID).Error; err != nil {
+		http.Error(w, "user not found", http.StatusUnauthorized)
+		return nil, nil, false
+	}
+	if claims.TokenVersion != user.TokenVersion {
+		http.Error(w, "token revoked", http.StatusUnauthorized)
+		return nil, nil, false
+	}
+	if claims.SessionID != "" && !touchSession(w, claims) {
+		return nil, nil, false
+	}
+	return &user, claims, true
+}
+
+// touchSession rejects tokens whose session was revoked and records the
+// session's last activity.
+func touchSession(w http.ResponseWriter, claims *utils.TokenClaims) bool {
+	var session models.Session
+	if err := config.DB.Where("id = ? AND user_id = ?", claims.SessionID, claims.UserID).First(&session).Error; err != nil || session.RevokedAt != nil {
+		http.Error(w, "session revoked", http.StatusUnauthorized)
+		return false
+	}
+	if now := time.Now(); now.Sub(session.LastSeenAt) >= sessionTouchInterval {
+		config.DB.Model(&models.Session{}).Where("id = ?", session.ID).Update("last_seen_at", now)
+	}
+	return true
+}
+
+// authenticateActor loads the admin named by an impersonation token's act claim.
+// The token stops working once the admin is disabled or loses the permission.
+func authenticateActor(w http.ResponseWriter, actorID uint) (*models.User, bool) {
+	var actor models.User
+	if err := config.DB.Preload("Roles.Permissions").First(&actor, actorID).Error; err != nil {
+		http.Error(w, "impersonator not found", http.StatusUnauthorized)
+		return nil, false
+	}
+	if actor.DisabledAt != nil || !actor.HasPermission(models.PermissionUsersImpersonate) {
+		http.Error(w, "impersonation revoked", http.StatusUnauthorized)
+		return nil, false
+	}
+	return &actor, true
+}
+
+// authenticateAPIKey looks up an API key by its hash and loads its owner.
+func authenticateAPIKey(w http.ResponseWriter, raw string) (*models.User, *models.APIKey, bool) {
+	var key models.APIKey
+	if err := config.DB.Where("key_hash = ?", utils.HashToken(raw)).First(&key).Error; err != nil {
+		http.Error(w, "invalid api key", http.StatusUnauthorized)
+		return nil, nil, false
+	}
+	now := time.Now()
+	if key.RevokedAt != nil {
+		http.Error(w, "api key revoked", http.StatusUnauthorized)
+		return nil, nil, false
+	}
+	if key.ExpiresAt != nil && now.After(*key.ExpiresAt) {
+		http.Error(w, "api key expired", http.StatusUnauthorized)
+		return nil, nil, false
+	}
+
+	var user models.User
+	if err := config.DB.Preload("Roles.Permissions").First(&user, key.UserID).Error; err != nil {
+		http.Error(w, "user not found", http.StatusUnauthorized)
+		return nil, nil, false
+	}
+
+	if key.LastUsedAt == nil || now.Sub(*key.LastUsedAt) >= apiKeyTouchInterval {
+		config.DB.Model(&models.APIKey{}).Where("id = ?", key.ID).Update("last_used_at", now)
+		key.LastUsedAt = &now
+	}
+	return &user, &key, true
+}
+
+// RequireAuth authenticates the request with a Bearer access token or an API key,
+// rejects revoked credentials, loads the user, and injects it into the request context.
+// Impersonated requests also carry the acting admin (see GetImpersonator).
 func RequireAuth(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		authz := r.Header.Get("Authorization")
-		if authz == "" || !strings.HasPrefix(strings.ToLower(authz), "bearer ") {
+		scheme, credential := credentials(r)
+		if (scheme != "bearer" && scheme != "apikey") || credential == "" {
 			http.Error(w, "missing or invalid authorization header", http.StatusUnauthorized)
 			return
 		}
-		tokenString := strings.TrimSpace(authz[len("Bearer "):])
-		if tokenString == "" {
-			http.Error(w, "missing token", http.StatusUnauthorized)
+
+		var (
+			user   *models.User
+			claims *utils.TokenClaims
+			apiKey *models.APIKey
+			ok     bool
+		)
+		if scheme == "apikey" {
+			user, apiKey, ok = authenticateAPIKey(w, credential)
+		} else {
+			user, claims, ok = authenticateToken(w, credential)
+		}
+		if !ok {
 			return
 		}
-
-		token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, jwt.ErrSignatureInvalid
+		var actor *models.User
+		if claims != nil && claims.ActorID != 0 {
+			if actor, ok = authenticateActor(w, claims.ActorID); !ok {
+				return
 			}
-			return []byte(os.Getenv("JWT_SECRET")), nil
-		})
-		if err != nil || !token.Valid {
-			http.Error(w, "invalid token", http.StatusUnauthorized)
+		}
+		if user.DisabledAt != nil {
+			http.Error(w, "account disabled", http.StatusForbidden)
 			return
 		}
-
-		claims, ok := token.Claims.(jwt.MapClaims)
-		if !ok {
-			http.Error(w, "invalid token claims", http.StatusUnauthorized)
+		if utils.EmailVerificationRequired() && user.EmailVerifiedAt == nil {
+			http.Error(w, "email not verified", http.StatusForbidden)
 			return
 		}
 
-		// we stored user id in "sub"
-		sub := claims["sub"]
-		var userID uint64
-		switch v := sub.(type) {
-		case float64:
-			userID = uint64(v)
-		case string:
-			if parsed, err := strconv.ParseUint(v, 10, 64); err == nil {
-				userID = parsed
-			}
+		ctx := context.WithValue(r.Context(), contextUserIDKey, user.ID)
+		ctx = context.WithValue(ctx, contextUserKey, user)
+		if claims != nil {
+			ctx = context.WithValue(ctx, contextClaimsKey, claims)
+		}
+		if apiKey != nil {
+			ctx = context.WithValue(ctx, contextAPIKeyKey, apiKey)
 		}
-		if userID == 0 {
-			http.Error(w, "invalid subject in token", http.StatusUnauthorized)
+		addLogFields(r, map[string]interface{}{"user_id": user.ID})
+		if actor != nil {
+			ctx = context.WithValue(ctx, contextActorKey, actor)
+			addLogFields(r, map[string]interface{}{"impersonated_by": actor.ID})
+		}
+		next(w, r.WithContext(ctx))
+	}
+}
+
+// RequireSession is RequireAuth for account-management endpoints: it only accepts
+// a user's access token, so an API key can't change the account or mint new keys.
+func RequireSession(next http.HandlerFunc) http.HandlerFunc {
+	return RequireAuth(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := GetAPIKey(r); ok {
+			http.Error(w, "not allowed with an api key", http.StatusForbidden)
 			return
 		}
+		next(w, r)
+	})
+}
 
-		var user models.User
-		if err := config.DB.First(&user, userID).Error; err != nil {
-			http.Error(w, "user not found", http.StatusUnauthorized)
+// BlockImpersonation rejects impersonated requests. It guards endpoints behind
+// RequireAuth that change credentials, the account itself or other accounts.
+func BlockImpersonation(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := GetImpersonator(r); ok {
+			http.Error(w, "not allowed while impersonating", http.StatusForbidden)
 			return
 		}
+		next(w, r)
+	}
+}
 
-		ctx := context.WithValue(r.Context(), contextUserIDKey, user.ID)
-		ctx = context.WithValue(ctx, contextUserKey, &user)
-		next(w, r.WithContext(ctx))
+// requireAdminMFA rejects privileged users without TOTP when REQUIRE_ADMIN_MFA=true.
+// Anyone holding a role can reach some admin endpoint, so all of them count as admins.
+func requireAdminMFA(w http.ResponseWriter, user *models.User) bool {
+	if utils.BoolFromEnv("REQUIRE_ADMIN_MFA") && len(user.Roles) > 0 && user.TOTPEnabledAt == nil {
+		http.Error(w, "two-factor authentication required for admins", http.StatusForbidden)
+		return false
 	}
+	return true
 }
 
-// RequireAdmin ensures the requester is authenticated and has admin privileges.
+// RequireAdmin ensures the requester is authenticated and holds the superadmin role.
+// API keys must be unscoped to act as the admin. With REQUIRE_ADMIN_MFA=true,
+// admins must also have enabled TOTP.
 func RequireAdmin(next http.HandlerFunc) http.HandlerFunc {
 	return RequireAuth(func(w http.ResponseWriter, r *http.Request) {
 		user, ok := GetAuthenticatedUser(r)
@@ -96,10 +254,44 @@ func RequireAdmin(next http.HandlerFunc) http.HandlerFunc {
 			http.Error(w, "unauthorized", http.StatusUnauthorized)
 			return
 		}
-		if !user.IsAdmin {
+		if !user.IsAdmin() {
 			http.Error(w, "forbidden", http.StatusForbidden)
 			return
 		}
+		if key, ok := GetAPIKey(r); ok && len(key.ScopeList()) > 0 {
+			http.Error(w, "forbidden: api key is scoped", http.StatusForbidden)
+			return
+		}
+		if !requireAdminMFA(w, user) {
+			return
+		}
 		next(w, r)
 	})
 }
+
+// RequirePermission returns a middleware ensuring the requester is authenticated
+// and granted permission (e.g. "videos:write") by one of their roles and, for
+// API keys, by the key's scopes.
+func RequirePermission(permission string) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return RequireAuth(func(w http.ResponseWriter, r *http.Request) {
+			user, ok := GetAuthenticatedUser(r)
+			if !ok || user == nil {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			if !user.HasPermission(permission) {
+				http.Error(w, "forbidden: missing permission "+permission, http.StatusForbidden)
+				return
+			}
+			if key, ok := GetAPIKey(r); ok && !key.Allows(permission) {
+				http.Error(w, "forbidden: api key lacks scope "+permission, http.StatusForbidden)
+				return
+			}
+			if !requireAdminMFA(w, user) {
+				return
+			}
+			next(w, r)
+		})
+	}
+}
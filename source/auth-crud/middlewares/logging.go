@@ -2,8 +2,10 @@ package middlewares
 
 import (
 	"bytes"
+	"context"
 	"io"
 	"net/http"
+	"strings"
 	"time"
 
 	"auth-crud/loggers"
@@ -26,7 +28,49 @@ func (rr *responseRecorder) Write(b []byte) (int, error) {
 	return rr.ResponseWriter.Write(b)
 }
 
-// Logging wraps handlers to log request/response with headers/body and errors as JSON.
+// contextLogFieldsKey holds fields that handlers further down add to the log line.
+const contextLogFieldsKey contextKey = "log.fields"
+
+// addLogFields adds fields to the line Logging writes for the request.
+func addLogFields(r *http.Request, extra map[string]interface{}) {
+	if fields, ok := r.Context().Value(contextLogFieldsKey).(map[string]interface{}); ok {
+		for k, v := range extra {
+			fields[k] = v
+		}
+	}
+}
+
+// redactedHeaders carry credentials and are logged as "[REDACTED]".
+var redactedHeaders = []string{"Authorization", "X-API-Key", "Cookie"}
+
+// unloggedBodyPrefixes are the paths whose request and response bodies carry
+// credentials (passwords, tokens, TOTP secrets, recovery codes, API keys) and
+// are never logged.
+var unloggedBodyPrefixes = []string{"/api/v1/auth/", "/api/v1/me", "/api/admin/v1/users/"}
+
+// logHeaders returns a copy of h with the credential headers redacted.
+func logHeaders(h http.Header) http.Header {
+	h = h.Clone()
+	for _, name := range redactedHeaders {
+		if h.Get(name) != "" {
+			h.Set(name, "[REDACTED]")
+		}
+	}
+	return h
+}
+
+func bodyLogged(path string) bool {
+	for _, prefix := range unloggedBodyPrefixes {
+		if strings.HasPrefix(path, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// Logging wraps handlers to log request/response with headers/body and errors
+// as JSON. Credential headers are redacted and the bodies of the auth, account
+// and user admin endpoints are left out.
 func Logging(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
@@ -40,6 +84,8 @@ func Logging(next http.Handler) http.Handler {
 
 		recorder := &responseRecorder{ResponseWriter: w, status: 200}
 		reqID := utils.GetOrSetRequestID(w, r)
+		extra := map[string]interface{}{}
+		r = r.WithContext(context.WithValue(r.Context(), contextLogFieldsKey, extra))
 
 		next.ServeHTTP(recorder, r)
 
@@ -51,9 +97,14 @@ func Logging(next http.Handler) http.Handler {
 			"path":        r.URL.Path,
 			"status":      recorder.status,
 			"duration_ms": dur.Milliseconds(),
-			"req_headers": r.Header,
-			"req_body":    string(reqBody),
-			"resp_body":   recorder.buf.String(),
+			"req_headers": logHeaders(r.Header),
+		}
+		if bodyLogged(r.URL.Path) {
+			fields["req_body"] = string(reqBody)
+			fields["resp_body"] = recorder.buf.String()
+		}
+		for k, v := range extra {
+			fields[k] = v
 		}
 		if recorder.status >= 400 {
 			fields["level"] = "error"
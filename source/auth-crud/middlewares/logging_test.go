@@ -0,0 +1,47 @@
+package middlewares
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestLogHeadersRedactsCredentials(t *testing.T) {
+	h := http.Header{}
+	h.Set("Authorization", "Bearer secret")
+	h.Set("X-API-Key", "ak_secret")
+	h.Set("Cookie", "oidc_state=secret")
+	h.Set("User-Agent", "curl")
+
+	got := logHeaders(h)
+	for _, name := range redactedHeaders {
+		if v := got.Get(name); v != "[REDACTED]" {
+			t.Errorf("%s = %q, want it redacted", name, v)
+		}
+	}
+	if got.Get("User-Agent") != "curl" {
+		t.Errorf("User-Agent = %q", got.Get("User-Agent"))
+	}
+	if h.Get("Authorization") != "Bearer secret" {
+		t.Error("the request headers were modified")
+	}
+}
+
+func TestBodyLogged(t *testing.T) {
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"/api/v1/auth/login", false},
+		{"/api/v1/auth/mfa/totp/enroll", false},
+		{"/api/v1/me", false},
+		{"/api/v1/me/api-keys", false},
+		{"/api/admin/v1/users/7/impersonate", false},
+		{"/api/v1/videos", true},
+		{"/api/admin/v1/categories", true},
+	}
+	for _, tt := range tests {
+		if got := bodyLogged(tt.path); got != tt.want {
+			t.Errorf("bodyLogged(%q) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
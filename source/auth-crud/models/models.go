@@ -1,30 +1,372 @@
 package models
 
-import "time"
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
 
+	"gorm.io/gorm"
+)
+
+// User is an account. TokenVersion is embedded in access tokens; bumping it
+// invalidates every token issued before. TOTPSecret is set at enrollment but
+// two-factor login is only enforced once TOTPEnabledAt is set by confirmation.
 type User struct {
+	ID              uint   `gorm:"primaryKey"`
+	Email           string `gorm:"unique;not null"`
+	Password        string `gorm:"not null"`
+	TokenVersion    uint   `gorm:"not null;default:0"`
+	EmailVerifiedAt *time.Time
+	TOTPSecret      string
+	TOTPEnabledAt   *time.Time
+	TOTPLastStep    int64 `gorm:"not null;default:0"`
+	DisabledAt      *time.Time
+	Roles           []Role    `gorm:"many2many:user_roles"`
+	CreatedAt       time.Time `gorm:"autoCreateTime"`
+}
+
+// HasRole reports whether the user holds the named role. Roles must be preloaded.
+func (u *User) HasRole(name string) bool {
+	for _, role := range u.Roles {
+		if role.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// HasPermission reports whether any of the user's roles grants permission.
+// Roles and their permissions must be preloaded.
+func (u *User) HasPermission(permission string) bool {
+	for _, role := range u.Roles {
+		for _, p := range role.Permissions {
+			if p.Name == permission {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// IsAdmin reports whether the user holds the built-in superadmin role.
+func (u *User) IsAdmin() bool {
+	return u.HasRole(RoleSuperadmin)
+}
+
+// Permissions checked by middlewares.RequirePermission.
+const (
+	PermissionVideosWrite      = "videos:write"
+	PermissionCategoriesWrite  = "categories:write"
+	PermissionUploadsCreate    = "uploads:create"
+	PermissionUsersManage      = "users:manage"
+	PermissionUsersImpersonate = "users:impersonate"
+	PermissionAuditRead        = "audit:read"
+)
+
+// Built-in roles, created at startup. The superadmin role always holds every permission.
+const (
+	RoleSuperadmin = "superadmin"
+	RoleEditor     = "editor"
+	RoleUploader   = "uploader"
+)
+
+// AllPermissions lists every permission known to the application.
+var AllPermissions = []string{
+	PermissionVideosWrite,
+	PermissionCategoriesWrite,
+	PermissionUploadsCreate,
+	PermissionUsersManage,
+	PermissionUsersImpersonate,
+	PermissionAuditRead,
+}
+
+// BuiltInRoles maps each built-in role to its permissions.
+var BuiltInRoles = map[string][]string{
+	RoleSuperadmin: AllPermissions,
+	RoleEditor:     {PermissionVideosWrite, PermissionCategoriesWrite, PermissionUploadsCreate},
+	RoleUploader:   {PermissionUploadsCreate},
+}
+
+type Role struct {
+	ID          uint         `gorm:"primaryKey"`
+	Name        string       `gorm:"uniqueIndex;not null"`
+	BuiltIn     bool         `gorm:"not null;default:false"`
+	Permissions []Permission `gorm:"many2many:role_permissions"`
+	CreatedAt   time.Time    `gorm:"autoCreateTime"`
+	UpdatedAt   time.Time    `gorm:"autoUpdateTime"`
+}
+
+type Permission struct {
 	ID        uint      `gorm:"primaryKey"`
-	Email     string    `gorm:"unique;not null"`
-	Password  string    `gorm:"not null"`
-	IsAdmin   bool      `gorm:"default:false"`
+	Name      string    `gorm:"uniqueIndex;not null"`
 	CreatedAt time.Time `gorm:"autoCreateTime"`
 }
 
+// Video is a video of a category. Its JSON also carries Duration, the
+// formatted DurationSeconds (see MarshalJSON). DurationSeconds is nil for
+// videos whose legacy duration couldn't be converted.
 type Video struct {
-	ID            uint      `gorm:"primaryKey"`
-	Title         string    `gorm:"not null"`
-	Duration      string    `gorm:"not null"`
-	URL           string    `gorm:"not null"`
-	ThumbnailPath string    `gorm:"not null"`
-	CategoryID    uint      `gorm:"not null"`
-	Category      Category  `json:"category"`
-	CreatedAt     time.Time `gorm:"autoCreateTime"`
-	UpdatedAt     time.Time `gorm:"autoUpdateTime"`
+	ID              uint      `gorm:"primaryKey"`
+	Title           string    `gorm:"not null"`
+	DurationSeconds *int64    `gorm:"index"`
+	URL             string    `gorm:"not null"`
+	ThumbnailPath   string    `gorm:"not null"`
+	CategoryID      uint      `gorm:"not null"`
+	Category        Category  `json:"category"`
+	CreatedAt       time.Time `gorm:"autoCreateTime"`
+	UpdatedAt       time.Time `gorm:"autoUpdateTime"`
+	// DeletedAt makes deletes soft: trashed videos are hidden from every query
+	// that doesn't use Unscoped until they are restored or purged.
+	DeletedAt gorm.DeletedAt `gorm:"index"`
+	// SearchVector is the full-text index of the video, set from
+	// VideoSearchVectorSQL whenever the video is written. GORM never reads or
+	// writes it directly.
+	SearchVector string `gorm:"type:tsvector;index:,type:gin;->:false;<-:false" json:"-"`
+}
+
+// VideoSearchConfig is the Postgres text search configuration of video search.
+const VideoSearchConfig = "english"
+
+// VideoSearchVectorSQL computes the search_vector of a row of videos. Titles
+// weigh most ('A'); descriptions and tags can be added with lower weights.
+const VideoSearchVectorSQL = "setweight(to_tsvector('" + VideoSearchConfig + "', coalesce(title, '')), 'A')"
+
+// MarshalJSON adds Duration, DurationSeconds formatted by FormatVideoDuration
+// (null when the duration is unknown).
+func (v Video) MarshalJSON() ([]byte, error) {
+	type video Video
+	var duration *string
+	if v.DurationSeconds != nil {
+		formatted := FormatVideoDuration(*v.DurationSeconds)
+		duration = &formatted
+	}
+	return json.Marshal(struct {
+		video
+		Duration *string
+	}{video(v), duration})
 }
 
+var ErrInvalidVideoDuration = errors.New(`duration must be ISO 8601 ("PT12M30S"), "hh:mm:ss" or like "12m"`)
+
+// videoDurationFormats are the accepted duration formats: ISO 8601, hh:mm:ss
+// and the legacy "1h2m3s" form, with the seconds in a unit of each group.
+var videoDurationFormats = []struct {
+	pattern *regexp.Regexp
+	units   []int64
+}{
+	{regexp.MustCompile(`(?i)^P(?:(\d{1,9})D)?(?:T(?:(\d{1,9})H)?(?:(\d{1,9})M)?(?:(\d{1,9})S)?)?$`), []int64{86400, 3600, 60, 1}},
+	{regexp.MustCompile(`^(\d{1,9}):([0-5]\d):([0-5]\d)$`), []int64{3600, 60, 1}},
+	{regexp.MustCompile(`^(?:(\d{1,9})h)?(?:(\d{1,9})m)?(?:(\d{1,9})s)?$`), []int64{3600, 60, 1}},
+}
+
+// ParseVideoDuration reads a video length in seconds from "PT12M30S",
+// "00:12:30" or "12m30s".
+func ParseVideoDuration(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	if strings.HasSuffix(strings.ToUpper(s), "T") {
+		return 0, ErrInvalidVideoDuration
+	}
+	for _, format := range videoDurationFormats {
+		groups := format.pattern.FindStringSubmatch(s)
+		if groups == nil {
+			continue
+		}
+		var seconds int64
+		matched := false
+		for i, group := range groups[1:] {
+			if group == "" {
+				continue
+			}
+			n, err := strconv.ParseInt(group, 10, 64)
+			if err != nil {
+				return 0, ErrInvalidVideoDuration
+			}
+			seconds += n * format.units[i]
+			matched = true
+		}
+		if matched {
+			return seconds, nil
+		}
+	}
+	return 0, ErrInvalidVideoDuration
+}
+
+// FormatVideoDuration renders seconds as "h:mm:ss" ("0:12:30"), which
+// ParseVideoDuration reads back.
+func FormatVideoDuration(seconds int64) string {
+	return fmt.Sprintf("%d:%02d:%02d", seconds/3600, seconds/60%60, seconds%60)
+}
+
+// Category is a node of the category tree; ParentID is nil for top-level
+// categories. Breadcrumb is filled by the handlers, from the root down to the
+// category itself.
 type Category struct {
+	ID         uint            `gorm:"primaryKey"`
+	Name       string          `gorm:"not null"`
+	ParentID   *uint           `gorm:"index"`
+	CreatedAt  time.Time       `gorm:"autoCreateTime"`
+	UpdatedAt  time.Time       `gorm:"autoUpdateTime"`
+	Breadcrumb []CategoryCrumb `gorm:"-" json:"breadcrumb,omitempty"`
+}
+
+// CategoryCrumb is one step of a category's breadcrumb.
+type CategoryCrumb struct {
+	ID   uint   `json:"id"`
+	Name string `json:"name"`
+}
+
+// RefreshToken is a hashed, single-use refresh token. Tokens obtained from the
+// same login share a FamilyID so that the whole chain can be revoked on reuse.
+type RefreshToken struct {
+	ID           uint      `gorm:"primaryKey"`
+	UserID       uint      `gorm:"not null;index"`
+	FamilyID     string    `gorm:"not null;index"`
+	TokenHash    string    `gorm:"uniqueIndex;not null"`
+	ExpiresAt    time.Time `gorm:"not null"`
+	RevokedAt    *time.Time
+	ReplacedByID *uint
+	CreatedAt    time.Time `gorm:"autoCreateTime"`
+}
+
+// Session is one login on one device. Its ID is the family id of the refresh
+// tokens started at login, and access tokens carry it as the "sid" claim.
+type Session struct {
+	ID         string `gorm:"primaryKey"`
+	UserID     uint   `gorm:"not null;index"`
+	UserAgent  string
+	IP         string
+	LastSeenAt time.Time
+	ExpiresAt  time.Time `gorm:"not null"`
+	RevokedAt  *time.Time
+	CreatedAt  time.Time `gorm:"autoCreateTime"`
+}
+
+// RevokedToken is a deny-list entry for an access token's jti. Entries can be
+// dropped once ExpiresAt has passed since the token would be rejected anyway.
+type RevokedToken struct {
+	JTI       string    `gorm:"primaryKey"`
+	UserID    uint      `gorm:"not null;index"`
+	ExpiresAt time.Time `gorm:"not null;index"`
+	CreatedAt time.Time `gorm:"autoCreateTime"`
+}
+
+// OneTimeToken is a hashed, expiring, single-use token mailed to a user, e.g. to
+// verify an email address. Purpose keeps tokens of different flows apart and
+// Email records the address the token was sent to.
+type OneTimeToken struct {
 	ID        uint      `gorm:"primaryKey"`
-	Name      string    `gorm:"not null"`
+	UserID    uint      `gorm:"not null;index"`
+	Purpose   string    `gorm:"not null;index"`
+	Email     string    `gorm:"not null"`
+	TokenHash string    `gorm:"uniqueIndex;not null"`
+	ExpiresAt time.Time `gorm:"not null"`
+	UsedAt    *time.Time
 	CreatedAt time.Time `gorm:"autoCreateTime"`
-	UpdatedAt time.Time `gorm:"autoUpdateTime"`
+}
+
+// MFARecoveryCode is a hashed one-time code that can replace a TOTP code,
+// e.g. when the authenticator device is lost.
+type MFARecoveryCode struct {
+	ID        uint   `gorm:"primaryKey"`
+	UserID    uint   `gorm:"not null;index"`
+	CodeHash  string `gorm:"not null"`
+	UsedAt    *time.Time
+	CreatedAt time.Time `gorm:"autoCreateTime"`
+}
+
+// LoginThrottle counts failed logins for a key ("email:<address>" or "ip:<addr>")
+// and holds the lockout they triggered.
+type LoginThrottle struct {
+	Key           string `gorm:"primaryKey"`
+	Failures      int    `gorm:"not null;default:0"`
+	LastFailureAt time.Time
+	LockedUntil   *time.Time
+	UpdatedAt     time.Time `gorm:"autoUpdateTime"`
+}
+
+// APIKey is a long-lived credential for machine-to-machine access. Only a hash of
+// the key is stored; Prefix identifies it in listings. Scopes, when set, is a
+// space-separated list of permissions that narrows what the owner's roles allow.
+type APIKey struct {
+	ID         uint   `gorm:"primaryKey"`
+	UserID     uint   `gorm:"not null;index"`
+	Name       string `gorm:"not null"`
+	Prefix     string `gorm:"not null"`
+	KeyHash    string `gorm:"uniqueIndex;not null"`
+	Scopes     string
+	ExpiresAt  *time.Time
+	LastUsedAt *time.Time
+	RevokedAt  *time.Time
+	CreatedAt  time.Time `gorm:"autoCreateTime"`
+}
+
+// ScopeList returns the key's scopes; empty means unrestricted.
+func (k *APIKey) ScopeList() []string {
+	return strings.Fields(k.Scopes)
+}
+
+// Allows reports whether the key's scopes permit permission. The owner must
+// still be granted the permission by a role.
+func (k *APIKey) Allows(permission string) bool {
+	scopes := k.ScopeList()
+	if len(scopes) == 0 {
+		return true
+	}
+	for _, scope := range scopes {
+		if scope == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// ExternalIdentity links a user to an account at an external OpenID Connect
+// provider, identified by the provider's stable subject claim.
+type ExternalIdentity struct {
+	ID          uint   `gorm:"primaryKey"`
+	UserID      uint   `gorm:"not null;index"`
+	Provider    string `gorm:"not null;uniqueIndex:idx_external_identity_subject"`
+	Subject     string `gorm:"not null;uniqueIndex:idx_external_identity_subject"`
+	Email       string
+	LastLoginAt *time.Time
+	CreatedAt   time.Time `gorm:"autoCreateTime"`
+}
+
+// OIDCLoginState is a pending OpenID Connect login between the redirect to the
+// provider and its callback. Only a hash of the state parameter is stored; the
+// nonce and PKCE code verifier are checked when the code is redeemed.
+type OIDCLoginState struct {
+	StateHash    string    `gorm:"primaryKey"`
+	Provider     string    `gorm:"not null"`
+	Nonce        string    `gorm:"not null"`
+	CodeVerifier string    `gorm:"not null"`
+	ExpiresAt    time.Time `gorm:"not null;index"`
+	CreatedAt    time.Time `gorm:"autoCreateTime"`
+}
+
+// AuditEvent records a change made through an admin or security-sensitive
+// endpoint. Changes is a JSON object mapping each changed field to its
+// {"before": ..., "after": ...} values. Events outlive the users they mention.
+type AuditEvent struct {
+	ID             uint   `gorm:"primaryKey"`
+	ActorID        *uint  `gorm:"index"`
+	ImpersonatorID *uint  `gorm:"index"`
+	Action         string `gorm:"not null;index"`
+	ResourceType   string `gorm:"not null;index:idx_audit_event_resource"`
+	ResourceID     string `gorm:"index:idx_audit_event_resource"`
+	Changes        string `gorm:"type:jsonb;not null;default:'{}'"`
+	RequestID      string `gorm:"index"`
+	IP             string
+	CreatedAt      time.Time `gorm:"autoCreateTime;index"`
+}
+
+// SchemaMigration records a one-time data migration that has been applied, so
+// that it never runs twice.
+type SchemaMigration struct {
+	Name      string    `gorm:"primaryKey"`
+	AppliedAt time.Time `gorm:"autoCreateTime"`
 }
@@ -0,0 +1,73 @@
+package models
+
+import "testing"
+
+func TestParseVideoDuration(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int64
+		wantErr bool
+	}{
+		// ISO 8601
+		{in: "PT12M30S", want: 750},
+		{in: "pt1h", want: 3600},
+		{in: "P1DT2H", want: 93600},
+		{in: "PT0S", want: 0},
+		{in: "P", wantErr: true},
+		{in: "PT", wantErr: true},
+		{in: "PT1.5S", wantErr: true},
+		// h:mm:ss
+		{in: "00:12:30", want: 750},
+		{in: "0:12:30", want: 750},
+		{in: "1:02:03", want: 3723},
+		{in: " 100:00:00 ", want: 360000},
+		{in: "12:30", wantErr: true},
+		{in: "0:60:00", wantErr: true},
+		{in: "0:00:60", wantErr: true},
+		// legacy 1h2m3s
+		{in: "12m", want: 720},
+		{in: "12m30s", want: 750},
+		{in: "1h2m3s", want: 3723},
+		{in: "90s", want: 90},
+		{in: "2m1h", wantErr: true},
+		{in: "", wantErr: true},
+		{in: "twelve minutes", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseVideoDuration(tt.in)
+		if tt.wantErr {
+			if err != ErrInvalidVideoDuration {
+				t.Errorf("ParseVideoDuration(%q) = %d, %v, want ErrInvalidVideoDuration", tt.in, got, err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("ParseVideoDuration(%q) = %d, %v, want %d", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestFormatVideoDurationRoundTrip(t *testing.T) {
+	tests := []struct {
+		seconds int64
+		want    string
+	}{
+		{0, "0:00:00"},
+		{59, "0:00:59"},
+		{750, "0:12:30"},
+		{3599, "0:59:59"},
+		{3600, "1:00:00"},
+		{3723, "1:02:03"},
+		{360000, "100:00:00"},
+	}
+	for _, tt := range tests {
+		got := FormatVideoDuration(tt.seconds)
+		if got != tt.want {
+			t.Errorf("FormatVideoDuration(%d) = %q, want %q", tt.seconds, got, tt.want)
+		}
+		back, err := ParseVideoDuration(got)
+		if err != nil || back != tt.seconds {
+			t.Errorf("ParseVideoDuration(%q) = %d, %v, want %d", got, back, err, tt.seconds)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package sso
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"auth-crud/utils"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+// Environment variables:
+// OIDC_CONFIG_FILE: JSON file of providers, {"providers": {"<name>": {"issuer": ..., "client_id": ...}}}
+// OIDC_PROVIDERS: comma-separated names of providers configured through the variables below
+// OIDC_<NAME>_ISSUER, OIDC_<NAME>_CLIENT_ID, OIDC_<NAME>_CLIENT_SECRET: provider and client registration
+// OIDC_<NAME>_REDIRECT_URL: callback registered at the provider (default APP_BASE_URL/api/v1/auth/oidc/<name>/callback)
+// OIDC_<NAME>_SCOPES: space-separated scopes (default "openid email profile")
+// OIDC_<NAME>_ALLOW_SIGNUP: create accounts for unknown identities (default false)
+
+// httpClient is used for discovery, key fetches and code exchanges.
+var httpClient = &http.Client{Timeout: 10 * time.Second}
+
+// ProviderConfig is the relying-party configuration for one OpenID Connect provider.
+type ProviderConfig struct {
+	Name         string   `json:"-"`
+	Issuer       string   `json:"issuer"`
+	ClientID     string   `json:"client_id"`
+	ClientSecret string   `json:"client_secret"`
+	RedirectURL  string   `json:"redirect_url"`
+	Scopes       []string `json:"scopes"`
+	AllowSignup  *bool    `json:"allow_signup"`
+}
+
+// Identity is what a provider asserted about the user in a verified ID token.
+type Identity struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+}
+
+// Provider is a configured provider. Its discovery document is fetched on first use.
+type Provider struct {
+	Config ProviderConfig
+
+	mu       sync.Mutex
+	oauth    *oauth2.Config
+	verifier *oidc.IDTokenVerifier
+}
+
+var (
+	providers     map[string]*Provider
+	providersErr  error
+	providersOnce sync.Once
+)
+
+// LoadProviders reads the provider configuration. It is safe to call more than
+// once; the configuration is only read the first time.
+func LoadProviders() error {
+	providersOnce.Do(func() {
+		providers, providersErr = loadProviders()
+	})
+	return providersErr
+}
+
+func loadProviders() (map[string]*Provider, error) {
+	configs := map[string]ProviderConfig{}
+
+	if path := os.Getenv("OIDC_CONFIG_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("OIDC_CONFIG_FILE: %w", err)
+		}
+		var file struct {
+			Providers map[string]ProviderConfig `json:"providers"`
+		}
+		if err := json.Unmarshal(data, &file); err != nil {
+			return nil, fmt.Errorf("OIDC_CONFIG_FILE: %w", err)
+		}
+		for name, cfg := range file.Providers {
+			configs[name] = cfg
+		}
+	}
+
+	for _, name := range strings.Split(os.Getenv("OIDC_PROVIDERS"), ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		env := func(key string) string {
+			return os.Getenv("OIDC_" + strings.ToUpper(name) + "_" + key)
+		}
+		cfg := ProviderConfig{
+			Issuer:       env("ISSUER"),
+			ClientID:     env("CLIENT_ID"),
+			ClientSecret: env("CLIENT_SECRET"),
+			RedirectURL:  env("REDIRECT_URL"),
+			Scopes:       strings.Fields(env("SCOPES")),
+		}
+		if v := env("ALLOW_SIGNUP"); v != "" {
+			allow, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, fmt.Errorf("OIDC_%s_ALLOW_SIGNUP: %w", strings.ToUpper(name), err)
+			}
+			cfg.AllowSignup = &allow
+		}
+		configs[name] = cfg
+	}
+
+	loaded := map[string]*Provider{}
+	for name, cfg := range configs {
+		if cfg.Issuer == "" || cfg.ClientID == "" {
+			return nil, fmt.Errorf("oidc provider %q: issuer and client_id are required", name)
+		}
+		cfg.Name = name
+		if cfg.RedirectURL == "" {
+			cfg.RedirectURL = utils.AppURL("/api/v1/auth/oidc/" + name + "/callback")
+		}
+		if len(cfg.Scopes) == 0 {
+			cfg.Scopes = []string{oidc.ScopeOpenID, "email", "profile"}
+		}
+		loaded[name] = &Provider{Config: cfg}
+	}
+	return loaded, nil
+}
+
+// Get returns the provider configured under name.
+func Get(name string) (*Provider, bool) {
+	if err := LoadProviders(); err != nil {
+		return nil, false
+	}
+	p, ok := providers[name]
+	return p, ok
+}
+
+// AllowsSignup reports whether unknown identities may create an account. It
+// must be turned on explicitly: otherwise anyone with an account at the
+// provider could create a local user.
+func (p *Provider) AllowsSignup() bool {
+	return p.Config.AllowSignup != nil && *p.Config.AllowSignup
+}
+
+// discover fetches the provider's discovery document once it succeeds; failures
+// are retried on the next call.
+func (p *Provider) discover(ctx context.Context) (*oauth2.Config, *oidc.IDTokenVerifier, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.oauth != nil {
+		return p.oauth, p.verifier, nil
+	}
+	// the provider keeps the context for later key fetches, so it must outlive the request
+	provider, err := oidc.NewProvider(oidc.ClientContext(context.WithoutCancel(ctx), httpClient), p.Config.Issuer)
+	if err != nil {
+		return nil, nil, fmt.Errorf("oidc discovery for %q: %w", p.Config.Name, err)
+	}
+	p.oauth = &oauth2.Config{
+		ClientID:     p.Config.ClientID,
+		ClientSecret: p.Config.ClientSecret,
+		RedirectURL:  p.Config.RedirectURL,
+		Endpoint:     provider.Endpoint(),
+		Scopes:       p.Config.Scopes,
+	}
+	p.verifier = provider.Verifier(&oidc.Config{ClientID: p.Config.ClientID})
+	return p.oauth, p.verifier, nil
+}
+
+// GenerateVerifier returns a new PKCE code verifier.
+func GenerateVerifier() string {
+	return oauth2.GenerateVerifier()
+}
+
+// AuthCodeURL returns the provider URL that starts an authorization code flow
+// bound to state, nonce and the PKCE verifier.
+func (p *Provider) AuthCodeURL(ctx context.Context, state, nonce, verifier string) (string, error) {
+	oauth, _, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	return oauth.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier)), nil
+}
+
+// Exchange redeems an authorization code and verifies the returned ID token
+// (signature, issuer, audience, expiry and nonce).
+func (p *Provider) Exchange(ctx context.Context, code, verifier, nonce string) (*Identity, error) {
+	oauth, idVerifier, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	token, err := oauth.Exchange(oidc.ClientContext(ctx, httpClient), code, oauth2.VerifierOption(verifier))
+	if err != nil {
+		return nil, fmt.Errorf("code exchange: %w", err)
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok || rawIDToken == "" {
+		return nil, errors.New("token response has no id_token")
+	}
+	idToken, err := idVerifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, fmt.Errorf("id token: %w", err)
+	}
+	if idToken.Nonce != nonce {
+		return nil, errors.New("id token: nonce mismatch")
+	}
+
+	var claims struct {
+		Email         string      `json:"email"`
+		EmailVerified interface{} `json:"email_verified"`
+	}
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, fmt.Errorf("id token claims: %w", err)
+	}
+	return &Identity{
+		Subject:       idToken.Subject,
+		Email:         strings.TrimSpace(strings.ToLower(claims.Email)),
+		EmailVerified: claims.EmailVerified == true || claims.EmailVerified == "true",
+	}, nil
+}
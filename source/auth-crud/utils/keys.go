@@ -0,0 +1,281 @@
+package utils
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// Environment variables:
+// JWT_SIGNING_KEY_FILE: PEM private key (RSA or Ed25519) used to sign tokens. When unset,
+//   tokens are signed with HS256 and JWT_SECRET.
+// JWT_SIGNING_KEY_ID: "kid" of the signing key (default: derived from the public key)
+// JWT_VERIFICATION_KEY_FILES: comma-separated "kid=path" (or just "path") PEM public keys
+//   that are still accepted for verification, e.g. the previous key during a rotation.
+
+type verificationKey struct {
+	kid    string
+	method jwt.SigningMethod
+	public crypto.PublicKey
+}
+
+type keySet struct {
+	signingKID    string
+	signingMethod jwt.SigningMethod
+	signingKey    crypto.PrivateKey
+	verification  map[string]verificationKey
+	// ordered kids for a stable JWKS document
+	kids []string
+}
+
+var (
+	keys     *keySet
+	keysErr  error
+	keysOnce sync.Once
+)
+
+// LoadSigningKeys reads the configured signing and verification keys. It is safe
+// to call more than once; the keys are only read the first time.
+func LoadSigningKeys() error {
+	keysOnce.Do(func() {
+		keys, keysErr = loadKeySet()
+	})
+	return keysErr
+}
+
+// asymmetric reports whether tokens are signed with a private key instead of JWT_SECRET.
+func (ks *keySet) asymmetric() bool {
+	return ks.signingKey != nil
+}
+
+func loadKeySet() (*keySet, error) {
+	ks := &keySet{verification: map[string]verificationKey{}}
+
+	path := os.Getenv("JWT_SIGNING_KEY_FILE")
+	if path == "" {
+		return ks, nil
+	}
+
+	private, err := readPrivateKey(path)
+	if err != nil {
+		return nil, fmt.Errorf("JWT_SIGNING_KEY_FILE: %w", err)
+	}
+	signer, ok := private.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("JWT_SIGNING_KEY_FILE: key cannot sign")
+	}
+	method, err := signingMethodFor(signer.Public())
+	if err != nil {
+		return nil, fmt.Errorf("JWT_SIGNING_KEY_FILE: %w", err)
+	}
+	kid := os.Getenv("JWT_SIGNING_KEY_ID")
+	if kid == "" {
+		if kid, err = keyThumbprint(signer.Public()); err != nil {
+			return nil, fmt.Errorf("JWT_SIGNING_KEY_FILE: %w", err)
+		}
+	}
+	ks.signingKID = kid
+	ks.signingMethod = method
+	ks.signingKey = private
+	ks.add(verificationKey{kid: kid, method: method, public: signer.Public()})
+
+	for _, entry := range strings.Split(os.Getenv("JWT_VERIFICATION_KEY_FILES"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		kid, file := "", entry
+		if i := strings.Index(entry, "="); i >= 0 {
+			kid, file = entry[:i], entry[i+1:]
+		}
+		public, err := readPublicKey(file)
+		if err != nil {
+			return nil, fmt.Errorf("JWT_VERIFICATION_KEY_FILES %s: %w", file, err)
+		}
+		method, err := signingMethodFor(public)
+		if err != nil {
+			return nil, fmt.Errorf("JWT_VERIFICATION_KEY_FILES %s: %w", file, err)
+		}
+		if kid == "" {
+			if kid, err = keyThumbprint(public); err != nil {
+				return nil, fmt.Errorf("JWT_VERIFICATION_KEY_FILES %s: %w", file, err)
+			}
+		}
+		if _, exists := ks.verification[kid]; exists {
+			return nil, fmt.Errorf("JWT_VERIFICATION_KEY_FILES: duplicate kid %q", kid)
+		}
+		ks.add(verificationKey{kid: kid, method: method, public: public})
+	}
+	return ks, nil
+}
+
+func (ks *keySet) add(k verificationKey) {
+	ks.verification[k.kid] = k
+	ks.kids = append(ks.kids, k.kid)
+}
+
+func loadedKeys() (*keySet, error) {
+	if err := LoadSigningKeys(); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func signingMethodFor(public crypto.PublicKey) (jwt.SigningMethod, error) {
+	switch public.(type) {
+	case *rsa.PublicKey:
+		return jwt.SigningMethodRS256, nil
+	case ed25519.PublicKey:
+		return jwt.SigningMethodEdDSA, nil
+	}
+	return nil, errors.New("unsupported key type, expected RSA or Ed25519")
+}
+
+// keyThumbprint derives a short, stable kid from the DER encoding of a public key.
+func keyThumbprint(public crypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(der)
+	return base64.RawURLEncoding.EncodeToString(sum[:12]), nil
+}
+
+func readPEM(path string) (*pem.Block, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+	return block, nil
+}
+
+func readPrivateKey(path string) (crypto.PrivateKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	if key, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	return nil, errors.New("unsupported private key format, expected PKCS#8 or PKCS#1")
+}
+
+func readPublicKey(path string) (crypto.PublicKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	switch block.Type {
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return cert.PublicKey, nil
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	}
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
+
+// signToken signs claims with the configured key, setting the "kid" header
+// when an asymmetric key is in use.
+func signToken(claims jwt.MapClaims) (string, error) {
+	ks, err := loadedKeys()
+	if err != nil {
+		return "", err
+	}
+	if !ks.asymmetric() {
+		return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(os.Getenv("JWT_SECRET")))
+	}
+	token := jwt.NewWithClaims(ks.signingMethod, claims)
+	token.Header["kid"] = ks.signingKID
+	return token.SignedString(ks.signingKey)
+}
+
+// tokenKeyFunc selects the verification key for a token by its "kid" header.
+// HS256 tokens are only accepted while no asymmetric key is configured.
+func tokenKeyFunc(token *jwt.Token) (interface{}, error) {
+	ks, err := loadedKeys()
+	if err != nil {
+		return nil, err
+	}
+	if !ks.asymmetric() {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, jwt.ErrSignatureInvalid
+		}
+		return []byte(os.Getenv("JWT_SECRET")), nil
+	}
+
+	kid, _ := token.Header["kid"].(string)
+	key, ok := ks.verification[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+	if token.Method.Alg() != key.method.Alg() {
+		return nil, jwt.ErrSignatureInvalid
+	}
+	return key.public, nil
+}
+
+// JWK is a single public key in JSON Web Key format (RFC 7517).
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+// JWKSet is the document served at /.well-known/jwks.json.
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// PublicJWKS returns every key currently accepted for verification. It is empty
+// when tokens are signed with the shared HS256 secret.
+func PublicJWKS() (JWKSet, error) {
+	set := JWKSet{Keys: []JWK{}}
+	ks, err := loadedKeys()
+	if err != nil {
+		return set, err
+	}
+	for _, kid := range ks.kids {
+		key := ks.verification[kid]
+		jwk := JWK{Kid: kid, Use: "sig", Alg: key.method.Alg()}
+		switch public := key.public.(type) {
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.Kty = "OKP"
+			jwk.Crv = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(public)
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+	return set, nil
+}
@@ -0,0 +1,278 @@
+package utils
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Environment variables:
+// PASSWORD_HASHER: algorithm for new hashes, "argon2id" (default) or "bcrypt"
+// BCRYPT_COST: bcrypt work factor (default 10)
+// ARGON2_MEMORY: argon2id memory in KiB (default 65536)
+// ARGON2_ITERATIONS: argon2id passes over memory (default 3)
+// ARGON2_PARALLELISM: argon2id lanes (default 2)
+// ARGON2_MAX_CONCURRENCY: argon2id hashes computed at once; further ones wait (default 4)
+//
+// Hashes of either algorithm are always accepted; Login rehashes the ones that
+// don't match the configured algorithm and parameters.
+
+// ErrPasswordMismatch is returned by VerifyPassword when the password is wrong.
+var ErrPasswordMismatch = errors.New("password does not match")
+
+// PasswordHasher produces and checks password hashes of one algorithm.
+type PasswordHasher interface {
+	// Hash returns the encoded hash of password, including algorithm, parameters and salt.
+	Hash(password string) (string, error)
+	// Verify checks password against an encoded hash of this algorithm.
+	Verify(password, encoded string) error
+	// Identifies reports whether encoded is a hash of this algorithm.
+	Identifies(encoded string) bool
+	// NeedsRehash reports whether encoded was made with other parameters than the configured ones.
+	NeedsRehash(encoded string) bool
+}
+
+// BcryptHasher hashes with bcrypt ($2a$<cost>$...).
+type BcryptHasher struct {
+	Cost int
+}
+
+func (h BcryptHasher) Hash(password string) (string, error) {
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), h.Cost)
+	return string(hashed), err
+}
+
+func (h BcryptHasher) Verify(password, encoded string) error {
+	err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return ErrPasswordMismatch
+	}
+	return err
+}
+
+func (h BcryptHasher) Identifies(encoded string) bool {
+	return strings.HasPrefix(encoded, "$2a$") || strings.HasPrefix(encoded, "$2b$") || strings.HasPrefix(encoded, "$2y$")
+}
+
+func (h BcryptHasher) NeedsRehash(encoded string) bool {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err != nil || cost != h.Cost
+}
+
+// Argon2idHasher hashes with argon2id, encoded in the PHC string format:
+// $argon2id$v=19$m=<memory>,t=<iterations>,p=<parallelism>$<salt>$<hash>
+type Argon2idHasher struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+}
+
+const (
+	argon2SaltLen = 16
+	argon2KeyLen  = 32
+	// bounds of the parameters accepted from stored hashes and the
+	// configuration, so that a hash can't make verification panic or
+	// exhaust memory and CPU
+	argon2MaxMemory     = 1024 * 1024 // KiB
+	argon2MaxIterations = 64
+	argon2MaxKeyLen     = 1024
+)
+
+// argon2Slots bounds the number of argon2id computations running at once, and
+// with it the memory they take (ARGON2_MEMORY each); Login and the dummy hash
+// of unknown accounts are reachable without authentication.
+var argon2Slots = make(chan struct{}, 4)
+
+func argon2Key(password, salt []byte, p Argon2idHasher, keyLen uint32) []byte {
+	argon2Slots <- struct{}{}
+	defer func() { <-argon2Slots }()
+	return argon2.IDKey(password, salt, p.Iterations, p.Memory, p.Parallelism, keyLen)
+}
+
+// validArgon2Params reports whether p can be computed within the bounds above.
+func validArgon2Params(p Argon2idHasher) error {
+	switch {
+	case p.Iterations < 1 || p.Iterations > argon2MaxIterations:
+		return fmt.Errorf("iterations must be between 1 and %d", argon2MaxIterations)
+	case p.Parallelism < 1:
+		return errors.New("parallelism must be at least 1")
+	case p.Memory < 8*uint32(p.Parallelism) || p.Memory > argon2MaxMemory:
+		return fmt.Errorf("memory must be between 8 KiB per lane and %d KiB", argon2MaxMemory)
+	}
+	return nil
+}
+
+var phcEncoding = base64.RawStdEncoding
+
+type argon2Hash struct {
+	params Argon2idHasher
+	salt   []byte
+	key    []byte
+}
+
+func (h Argon2idHasher) Hash(password string) (string, error) {
+	salt := make([]byte, argon2SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2Key([]byte(password), salt, h, argon2KeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, h.Memory, h.Iterations, h.Parallelism,
+		phcEncoding.EncodeToString(salt), phcEncoding.EncodeToString(key)), nil
+}
+
+func (h Argon2idHasher) Verify(password, encoded string) error {
+	parsed, err := parseArgon2id(encoded)
+	if err != nil {
+		return err
+	}
+	key := argon2Key([]byte(password), parsed.salt, parsed.params, uint32(len(parsed.key)))
+	if subtle.ConstantTimeCompare(key, parsed.key) != 1 {
+		return ErrPasswordMismatch
+	}
+	return nil
+}
+
+func (h Argon2idHasher) Identifies(encoded string) bool {
+	return strings.HasPrefix(encoded, "$argon2id$")
+}
+
+func (h Argon2idHasher) NeedsRehash(encoded string) bool {
+	parsed, err := parseArgon2id(encoded)
+	return err != nil || parsed.params != h || len(parsed.key) != argon2KeyLen
+}
+
+func parseArgon2id(encoded string) (*argon2Hash, error) {
+	// "", "argon2id", "v=19", "m=..,t=..,p=..", salt, hash
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return nil, errors.New("argon2id: malformed hash")
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, errors.New("argon2id: unsupported version")
+	}
+	var h argon2Hash
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &h.params.Memory, &h.params.Iterations, &h.params.Parallelism); err != nil {
+		return nil, fmt.Errorf("argon2id: malformed parameters: %w", err)
+	}
+	if err := validArgon2Params(h.params); err != nil {
+		return nil, fmt.Errorf("argon2id: %w", err)
+	}
+	var err error
+	if h.salt, err = phcEncoding.DecodeString(parts[4]); err != nil {
+		return nil, fmt.Errorf("argon2id: malformed salt: %w", err)
+	}
+	if h.key, err = phcEncoding.DecodeString(parts[5]); err != nil || len(h.key) < 4 || len(h.key) > argon2MaxKeyLen {
+		return nil, errors.New("argon2id: malformed hash")
+	}
+	return &h, nil
+}
+
+var (
+	hasher     PasswordHasher
+	hasherErr  error
+	hasherOnce sync.Once
+)
+
+// LoadPasswordHasher reads the hashing configuration. It is safe to call more
+// than once; the configuration is only read the first time.
+func LoadPasswordHasher() error {
+	hasherOnce.Do(func() {
+		hasher, hasherErr = loadPasswordHasher()
+	})
+	return hasherErr
+}
+
+func loadPasswordHasher() (PasswordHasher, error) {
+	switch algorithm := os.Getenv("PASSWORD_HASHER"); algorithm {
+	case "bcrypt":
+		cost, err := uintFromEnv("BCRYPT_COST", uint64(bcrypt.DefaultCost), uint64(bcrypt.MaxCost))
+		if err != nil {
+			return nil, err
+		}
+		if cost < uint64(bcrypt.MinCost) {
+			return nil, fmt.Errorf("BCRYPT_COST: must be at least %d", bcrypt.MinCost)
+		}
+		return BcryptHasher{Cost: int(cost)}, nil
+	case "", "argon2id":
+		memory, err := uintFromEnv("ARGON2_MEMORY", 64*1024, argon2MaxMemory)
+		if err != nil {
+			return nil, err
+		}
+		iterations, err := uintFromEnv("ARGON2_ITERATIONS", 3, argon2MaxIterations)
+		if err != nil {
+			return nil, err
+		}
+		parallelism, err := uintFromEnv("ARGON2_PARALLELISM", 2, 255)
+		if err != nil {
+			return nil, err
+		}
+		if memory < 8*parallelism {
+			return nil, errors.New("ARGON2_MEMORY: must be at least 8 KiB per lane")
+		}
+		concurrency, err := uintFromEnv("ARGON2_MAX_CONCURRENCY", 4, 1024)
+		if err != nil {
+			return nil, err
+		}
+		argon2Slots = make(chan struct{}, concurrency)
+		return Argon2idHasher{Memory: uint32(memory), Iterations: uint32(iterations), Parallelism: uint8(parallelism)}, nil
+	default:
+		return nil, fmt.Errorf("PASSWORD_HASHER: unknown algorithm %q", algorithm)
+	}
+}
+
+func uintFromEnv(key string, def, max uint64) (uint64, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.ParseUint(v, 10, 64)
+	if err != nil || n == 0 || n > max {
+		return 0, fmt.Errorf("%s: invalid value %q", key, v)
+	}
+	return n, nil
+}
+
+// CurrentPasswordHasher returns the hasher new passwords are hashed with.
+func CurrentPasswordHasher() PasswordHasher {
+	if err := LoadPasswordHasher(); err != nil {
+		// main refuses to start in that case; keep the library usable regardless
+		return BcryptHasher{Cost: bcrypt.DefaultCost}
+	}
+	return hasher
+}
+
+// knownHashers are tried in order to verify stored hashes of any supported algorithm.
+var knownHashers = []PasswordHasher{Argon2idHasher{}, BcryptHasher{}}
+
+// HashPassword hashes password with the configured algorithm and parameters.
+func HashPassword(password string) (string, error) {
+	return CurrentPasswordHasher().Hash(password)
+}
+
+// VerifyPassword checks password against a stored hash of any supported algorithm.
+func VerifyPassword(password, hashedPassword string) error {
+	for _, h := range knownHashers {
+		if h.Identifies(hashedPassword) {
+			return h.Verify(password, hashedPassword)
+		}
+	}
+	return errors.New("unrecognized password hash")
+}
+
+// PasswordNeedsRehash reports whether a stored hash uses another algorithm or
+// other parameters than the configured hasher.
+func PasswordNeedsRehash(hashedPassword string) bool {
+	current := CurrentPasswordHasher()
+	return !current.Identifies(hashedPassword) || current.NeedsRehash(hashedPassword)
+}
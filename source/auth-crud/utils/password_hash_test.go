@@ -0,0 +1,52 @@
+package utils
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestArgon2idHasherRoundTrip(t *testing.T) {
+	h := Argon2idHasher{Memory: 64, Iterations: 1, Parallelism: 1}
+	encoded, err := h.Hash("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Verify("correct horse", encoded); err != nil {
+		t.Errorf("Verify(correct password) = %v", err)
+	}
+	if err := h.Verify("wrong horse", encoded); !errors.Is(err, ErrPasswordMismatch) {
+		t.Errorf("Verify(wrong password) = %v, want ErrPasswordMismatch", err)
+	}
+	if h.NeedsRehash(encoded) {
+		t.Error("NeedsRehash of a hash with the same parameters = true")
+	}
+}
+
+func TestParseArgon2idRejectsUnsafeParameters(t *testing.T) {
+	const salt, key = "c29tZXNhbHRzb21lc2FsdA", "a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2U"
+	tests := []struct {
+		name   string
+		params string
+		ok     bool
+	}{
+		{"valid", "m=64,t=1,p=1", true},
+		{"zero iterations", "m=64,t=0,p=1", false},
+		{"too many iterations", "m=64,t=65,p=1", false},
+		{"zero parallelism", "m=64,t=1,p=0", false},
+		{"parallelism out of range", "m=64,t=1,p=256", false},
+		{"memory below 8 KiB per lane", "m=15,t=1,p=2", false},
+		{"memory above the limit", "m=4294967295,t=1,p=1", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encoded := "$argon2id$v=19$" + tt.params + "$" + salt + "$" + key
+			if _, err := parseArgon2id(encoded); (err == nil) != tt.ok {
+				t.Fatalf("parseArgon2id(%s) error = %v, want ok %v", tt.params, err, tt.ok)
+			}
+			// must fail cleanly rather than panic inside argon2
+			if err := VerifyPassword("password", encoded); tt.ok == (err != nil && !errors.Is(err, ErrPasswordMismatch)) {
+				t.Errorf("VerifyPassword error = %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,226 @@
+package utils
+
+import (
+	"bufio"
+	"crypto/sha1"
+	_ "embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Environment variables:
+// PASSWORD_MIN_LENGTH: minimum length in characters (default 8)
+// PASSWORD_MIN_CLASSES: how many of lowercase, uppercase, digits and symbols a password must mix (default 3)
+// PASSWORD_SKIP_BREACH_CHECK: set to true to accept passwords found in the breached list
+// PASSWORD_BREACH_FILE: breached-password list used instead of the bundled one. Either a file of
+// uppercase SHA-1 hashes (HASH or HASH:COUNT per line) or a directory of k-anonymity range files
+// named by the 5-character hash prefix (PREFIX or PREFIX.txt, holding SUFFIX:COUNT lines), the
+// layout produced by the Have I Been Pwned downloader.
+
+// MaxPasswordBytes is bcrypt's input limit; longer passwords would be silently truncated.
+const MaxPasswordBytes = 72
+
+const breachPrefixLen = 5
+
+//go:embed breached_passwords.txt
+var bundledBreachList string
+
+type passwordPolicy struct {
+	minLength  int
+	minClasses int
+	skipBreach bool
+	// breached maps a hash prefix to the suffixes listed under it; nil when rangeDir is used
+	breached map[string]map[string]bool
+	rangeDir string
+}
+
+var (
+	policy     *passwordPolicy
+	policyErr  error
+	policyOnce sync.Once
+)
+
+// LoadPasswordPolicy reads the password policy and breached-password list. It is
+// safe to call more than once; the configuration is only read the first time.
+func LoadPasswordPolicy() error {
+	policyOnce.Do(func() {
+		policy, policyErr = loadPasswordPolicy()
+	})
+	return policyErr
+}
+
+func loadPasswordPolicy() (*passwordPolicy, error) {
+	p := &passwordPolicy{minLength: 8, minClasses: 3, skipBreach: BoolFromEnv("PASSWORD_SKIP_BREACH_CHECK")}
+	if v := os.Getenv("PASSWORD_MIN_LENGTH"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("PASSWORD_MIN_LENGTH: invalid value %q", v)
+		}
+		p.minLength = n
+	}
+	if v := os.Getenv("PASSWORD_MIN_CLASSES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > 4 {
+			return nil, fmt.Errorf("PASSWORD_MIN_CLASSES: must be between 0 and 4, got %q", v)
+		}
+		p.minClasses = n
+	}
+	if p.skipBreach {
+		return p, nil
+	}
+
+	path := os.Getenv("PASSWORD_BREACH_FILE")
+	if path == "" {
+		p.breached = map[string]map[string]bool{}
+		return p, indexBreachList(p.breached, strings.NewReader(bundledBreachList))
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("PASSWORD_BREACH_FILE: %w", err)
+	}
+	if info.IsDir() {
+		p.rangeDir = path
+		return p, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("PASSWORD_BREACH_FILE: %w", err)
+	}
+	defer f.Close()
+	p.breached = map[string]map[string]bool{}
+	if err := indexBreachList(p.breached, f); err != nil {
+		return nil, fmt.Errorf("PASSWORD_BREACH_FILE: %w", err)
+	}
+	return p, nil
+}
+
+// indexBreachList reads HASH[:COUNT] lines, grouping them by hash prefix.
+func indexBreachList(index map[string]map[string]bool, r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		hash, _, _ := strings.Cut(line, ":")
+		hash = strings.ToUpper(hash)
+		if len(hash) != sha1.Size*2 {
+			return fmt.Errorf("malformed hash %q", hash)
+		}
+		prefix, suffix := hash[:breachPrefixLen], hash[breachPrefixLen:]
+		if index[prefix] == nil {
+			index[prefix] = map[string]bool{}
+		}
+		index[prefix][suffix] = true
+	}
+	return scanner.Err()
+}
+
+// inRangeFile looks suffix up in the range file for prefix. A missing file means no breaches.
+func (p *passwordPolicy) inRangeFile(prefix, suffix string) bool {
+	for _, name := range []string{prefix, prefix + ".txt"} {
+		f, err := os.Open(filepath.Join(p.rangeDir, name))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return false
+		}
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			listed, _, _ := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+			if strings.EqualFold(listed, suffix) {
+				return true
+			}
+		}
+		return false
+	}
+	return false
+}
+
+// IsBreachedPassword reports whether password appears in the breached-password list.
+func IsBreachedPassword(password string) bool {
+	p := currentPolicy()
+	if p.skipBreach {
+		return false
+	}
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:breachPrefixLen], hash[breachPrefixLen:]
+	if p.rangeDir != "" {
+		return p.inRangeFile(prefix, suffix)
+	}
+	return p.breached[prefix][suffix]
+}
+
+// ValidatePassword checks password against the configured policy for the account
+// with the given email. It returns every reason the password is rejected, or nil.
+func ValidatePassword(password, email string) []string {
+	p := currentPolicy()
+	var reasons []string
+
+	if utf8.RuneCountInString(password) < p.minLength {
+		reasons = append(reasons, fmt.Sprintf("must be at least %d characters long", p.minLength))
+	}
+	if len(password) > MaxPasswordBytes {
+		reasons = append(reasons, fmt.Sprintf("must be at most %d bytes long", MaxPasswordBytes))
+	}
+
+	var lower, upper, digit, symbol bool
+	for _, c := range password {
+		switch {
+		case unicode.IsLower(c):
+			lower = true
+		case unicode.IsUpper(c):
+			upper = true
+		case unicode.IsDigit(c):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+	classes := 0
+	for _, has := range []bool{lower, upper, digit, symbol} {
+		if has {
+			classes++
+		}
+	}
+	if classes < p.minClasses {
+		reasons = append(reasons, fmt.Sprintf("must mix at least %d of lowercase letters, uppercase letters, digits and symbols", p.minClasses))
+	}
+
+	if email != "" {
+		lowered := strings.ToLower(password)
+		email = strings.ToLower(email)
+		local, _, _ := strings.Cut(email, "@")
+		if strings.Contains(lowered, email) || (len(local) >= 3 && strings.Contains(lowered, local)) {
+			reasons = append(reasons, "must not contain your email address")
+		}
+	}
+
+	if IsBreachedPassword(password) {
+		reasons = append(reasons, "appears in a list of breached passwords")
+	}
+	return reasons
+}
+
+// currentPolicy returns the loaded policy, falling back to the defaults if the
+// configured one failed to load (main refuses to start in that case).
+func currentPolicy() *passwordPolicy {
+	if err := LoadPasswordPolicy(); err != nil {
+		fallback := &passwordPolicy{minLength: 8, minClasses: 3, breached: map[string]map[string]bool{}}
+		_ = indexBreachList(fallback.breached, strings.NewReader(bundledBreachList))
+		return fallback
+	}
+	return policy
+}
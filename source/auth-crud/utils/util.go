@@ -1,9 +1,14 @@
 package utils
 
 import (
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"net"
 	"net/http"
 	"os"
 	"strconv"
@@ -11,7 +16,6 @@ import (
 	"time"
 
 	"github.com/golang-jwt/jwt/v4"
-	"golang.org/x/crypto/bcrypt"
 )
 
 type ResponseStatus string
@@ -46,10 +50,19 @@ func generateRequestID() string {
 	return hex.EncodeToString(b)
 }
 
+// RandomID returns a random hex identifier (used for request ids, token families, ...).
+func RandomID() string {
+	return generateRequestID()
+}
+
+// GetOrSetRequestID returns the request's X-Request-Id, generating one if the
+// client sent none. The id is kept on the request so later calls (response
+// envelope, audit events, access log) all see the same value.
 func GetOrSetRequestID(w http.ResponseWriter, r *http.Request) string {
 	reqID := r.Header.Get("X-Request-Id")
 	if reqID == "" {
 		reqID = generateRequestID()
+		r.Header.Set("X-Request-Id", reqID)
 	}
 	w.Header().Set("X-Request-Id", reqID)
 	return reqID
@@ -104,23 +117,260 @@ func JSONError(w http.ResponseWriter, r *http.Request, httpStatus int, message s
 	writeJSON(w, httpStatus, resp)
 }
 
-// Password helpers
-func HashPassword(password string) (string, error) {
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-	return string(hashedPassword), err
+// JWT helpers
+
+// TokenSubject describes who an access token is issued for.
+// TokenVersion must match the user's current version for the token to be accepted.
+// SessionID, when set, ties the token to a login session ("sid" claim).
+// ActorID, when set, is the admin acting as the user ("act" claim, RFC 8693).
+type TokenSubject struct {
+	UserID       uint
+	TokenVersion uint
+	SessionID    string
+	ActorID      uint
 }
 
-func VerifyPassword(password, hashedPassword string) error {
-	return bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(password))
+// TokenClaims are the validated claims of an access token.
+type TokenClaims struct {
+	ID           string
+	UserID       uint
+	TokenVersion uint
+	SessionID    string
+	ActorID      uint
+	ExpiresAt    time.Time
 }
 
-// JWT helpers
-func GenerateToken(userID uint) (string, error) {
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"sub": userID,
-		"exp": time.Now().Add(time.Hour * 24).Unix(),
-	})
-	return token.SignedString([]byte(os.Getenv("JWT_SECRET")))
+// Token types carried in the "typ" claim. Tokens without one predate the claim and are access tokens.
+const (
+	tokenTypeAccess = "access"
+	tokenTypeMFA    = "mfa_pending"
+)
+
+func GenerateToken(subject TokenSubject) (string, error) {
+	return generateJWT(subject, tokenTypeAccess, AccessTokenTTL())
+}
+
+// GenerateMFAToken issues the short-lived token proving the password step of a
+// two-step login. It is only accepted by ParseMFAToken, never as an access token.
+func GenerateMFAToken(subject TokenSubject) (string, error) {
+	return generateJWT(subject, tokenTypeMFA, DurationFromEnv("MFA_TOKEN_TTL", 5*time.Minute))
+}
+
+// GenerateImpersonationToken issues an access token that lets subject.ActorID
+// act as subject.UserID. It lives for ImpersonationTokenTTL and can't be refreshed.
+func GenerateImpersonationToken(subject TokenSubject) (string, error) {
+	if subject.ActorID == 0 {
+		return "", errors.New("impersonation token needs an actor")
+	}
+	return generateJWT(subject, tokenTypeAccess, ImpersonationTokenTTL())
+}
+
+func generateJWT(subject TokenSubject, typ string, ttl time.Duration) (string, error) {
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"sub": subject.UserID,
+		"ver": subject.TokenVersion,
+		"typ": typ,
+		"jti": RandomID(),
+		"iat": now.Unix(),
+		"exp": now.Add(ttl).Unix(),
+	}
+	if subject.SessionID != "" {
+		claims["sid"] = subject.SessionID
+	}
+	if subject.ActorID != 0 {
+		claims["act"] = map[string]interface{}{"sub": subject.ActorID}
+	}
+	return signToken(claims)
+}
+
+// ParseToken verifies the signature and expiry of an access token and extracts its claims.
+func ParseToken(tokenString string) (*TokenClaims, error) {
+	return parseJWT(tokenString, tokenTypeAccess)
+}
+
+// ParseMFAToken verifies a token issued by GenerateMFAToken.
+func ParseMFAToken(tokenString string) (*TokenClaims, error) {
+	return parseJWT(tokenString, tokenTypeMFA)
+}
+
+func parseJWT(tokenString string, wantType string) (*TokenClaims, error) {
+	token, err := jwt.Parse(tokenString, tokenKeyFunc)
+	if err != nil || !token.Valid {
+		return nil, errors.New("invalid token")
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return nil, errors.New("invalid token claims")
+	}
+	typ, _ := claims["typ"].(string)
+	if typ == "" {
+		typ = tokenTypeAccess
+	}
+	if typ != wantType {
+		return nil, errors.New("invalid token type")
+	}
+
+	// user id is stored in "sub"
+	parsed := &TokenClaims{UserID: uintClaim(claims["sub"]), TokenVersion: uintClaim(claims["ver"])}
+	if parsed.UserID == 0 {
+		return nil, errors.New("invalid subject in token")
+	}
+	if jti, ok := claims["jti"].(string); ok {
+		parsed.ID = jti
+	}
+	if parsed.ID == "" {
+		return nil, errors.New("missing token id")
+	}
+	parsed.SessionID, _ = claims["sid"].(string)
+	if act, ok := claims["act"]; ok {
+		actor, _ := act.(map[string]interface{})
+		if parsed.ActorID = uintClaim(actor["sub"]); parsed.ActorID == 0 {
+			return nil, errors.New("invalid actor in token")
+		}
+	}
+	if exp, ok := claims["exp"].(float64); ok {
+		parsed.ExpiresAt = time.Unix(int64(exp), 0)
+	}
+	return parsed, nil
+}
+
+func uintClaim(v interface{}) uint {
+	switch v := v.(type) {
+	case float64:
+		if v > 0 {
+			return uint(v)
+		}
+	case string:
+		if parsed, err := strconv.ParseUint(v, 10, 64); err == nil {
+			return uint(parsed)
+		}
+	}
+	return 0
+}
+
+// AccessTokenTTL is the lifetime of access tokens (ACCESS_TOKEN_TTL, default 15m).
+func AccessTokenTTL() time.Duration {
+	return DurationFromEnv("ACCESS_TOKEN_TTL", 15*time.Minute)
+}
+
+// ImpersonationTokenTTL is the lifetime of impersonation tokens (IMPERSONATION_TOKEN_TTL, default 10m).
+func ImpersonationTokenTTL() time.Duration {
+	return DurationFromEnv("IMPERSONATION_TOKEN_TTL", 10*time.Minute)
+}
+
+// RefreshTokenTTL is the lifetime of refresh tokens (REFRESH_TOKEN_TTL, default 720h).
+func RefreshTokenTTL() time.Duration {
+	return DurationFromEnv("REFRESH_TOKEN_TTL", 30*24*time.Hour)
+}
+
+// DurationFromEnv parses a Go duration (e.g. "15m") from the environment, falling back to def.
+func DurationFromEnv(key string, def time.Duration) time.Duration {
+	if v := os.Getenv(key); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			return d
+		}
+	}
+	return def
+}
+
+// Opaque token helpers
+// GenerateOpaqueToken returns a random, URL-safe token carrying 32 bytes of entropy.
+func GenerateOpaqueToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// HashToken returns the hex SHA-256 digest under which opaque tokens are stored.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// GenerateSignedToken returns an opaque token bound to purpose by an HMAC
+// (TOKEN_SIGNING_SECRET, falling back to JWT_SECRET). Forged or cross-purpose
+// tokens are rejected by VerifySignedToken before any database lookup.
+func GenerateSignedToken(purpose string) (string, error) {
+	raw, err := GenerateOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+	return raw + "." + signTokenValue(purpose, raw), nil
+}
+
+// VerifySignedToken reports whether token was produced by GenerateSignedToken for purpose.
+func VerifySignedToken(purpose, token string) bool {
+	raw, sig, ok := strings.Cut(token, ".")
+	if !ok || raw == "" {
+		return false
+	}
+	return hmac.Equal([]byte(sig), []byte(signTokenValue(purpose, raw)))
+}
+
+// CheckTokenSigningSecret returns an error when neither TOKEN_SIGNING_SECRET nor
+// JWT_SECRET is set, as when JWTs are signed with a private key: signed tokens
+// and cursors would otherwise carry an HMAC with an empty key.
+func CheckTokenSigningSecret() error {
+	if tokenSigningSecret() == "" {
+		return errors.New("TOKEN_SIGNING_SECRET or JWT_SECRET must be set")
+	}
+	return nil
+}
+
+func tokenSigningSecret() string {
+	if secret := os.Getenv("TOKEN_SIGNING_SECRET"); secret != "" {
+		return secret
+	}
+	return os.Getenv("JWT_SECRET")
+}
+
+func signTokenValue(purpose, raw string) string {
+	mac := hmac.New(sha256.New, []byte(tokenSigningSecret()))
+	mac.Write([]byte(purpose + "." + raw))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// BoolFromEnv reports whether the environment variable is set to a true value ("true", "1", ...).
+func BoolFromEnv(key string) bool {
+	v, _ := strconv.ParseBool(os.Getenv(key))
+	return v
+}
+
+// EmailVerificationRequired reports whether unverified users are rejected (REQUIRE_EMAIL_VERIFICATION).
+func EmailVerificationRequired() bool {
+	return BoolFromEnv("REQUIRE_EMAIL_VERIFICATION")
+}
+
+// ClientIP returns the caller's IP address. X-Forwarded-For / X-Real-IP are only
+// trusted when TRUST_PROXY_HEADERS=true, i.e. when running behind a proxy that sets them.
+func ClientIP(r *http.Request) string {
+	if BoolFromEnv("TRUST_PROXY_HEADERS") {
+		if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+			first, _, _ := strings.Cut(xff, ",")
+			return strings.TrimSpace(first)
+		}
+		if ip := r.Header.Get("X-Real-IP"); ip != "" {
+			return strings.TrimSpace(ip)
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// AppURL joins path onto APP_BASE_URL (default http://localhost:8080) for links sent to users.
+func AppURL(path string) string {
+	base := os.Getenv("APP_BASE_URL")
+	if base == "" {
+		base = "http://localhost:8080"
+	}
+	return strings.TrimRight(base, "/") + path
 }
 
 // Pagination helpers (cursor + sort)
@@ -144,9 +394,41 @@ func ParsePagination(r *http.Request) (limit int, cursor string, sortBy string,
 	return
 }
 
-func BuildNextCursor(itemsLen int, limit int, lastID uint) string {
-	if itemsLen < limit {
-		return ""
+// Cursor is a position in a list sorted by SortBy, then id, in Order. Key is
+// the sort value of the item at the position (RFC 3339 for created_at, empty
+// when sorting by id). A Backward cursor selects the items before the position
+// instead of those after it.
+type Cursor struct {
+	SortBy   string `json:"s"`
+	Order    string `json:"o"`
+	Key      string `json:"k,omitempty"`
+	ID       uint   `json:"i"`
+	Backward bool   `json:"b,omitempty"`
+}
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// EncodeCursor returns c as an opaque string for clients to send back. It is
+// signed like GenerateSignedToken so that clients can't forge positions.
+func EncodeCursor(c Cursor) string {
+	data, _ := json.Marshal(c)
+	raw := base64.RawURLEncoding.EncodeToString(data)
+	return raw + "." + signTokenValue("cursor", raw)
+}
+
+// DecodeCursor verifies and decodes a cursor built by EncodeCursor.
+func DecodeCursor(s string) (Cursor, error) {
+	var c Cursor
+	raw, sig, ok := strings.Cut(s, ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(signTokenValue("cursor", raw))) {
+		return c, ErrInvalidCursor
+	}
+	data, err := base64.RawURLEncoding.DecodeString(raw)
+	if err != nil {
+		return c, ErrInvalidCursor
+	}
+	if err := json.Unmarshal(data, &c); err != nil {
+		return Cursor{}, ErrInvalidCursor
 	}
-	return strconv.FormatUint(uint64(lastID), 10)
+	return c, nil
 }